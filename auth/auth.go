@@ -1,22 +1,21 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
 
 	"github.com/google/go-github/github"
-
-	"golang.org/x/net/context"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
-	"gopkg.in/codegangsta/cli.v1"
+	"gopkg.in/urfave/cli.v1"
 )
 
 // getTokenFromWeb uses Config to request a Token.
@@ -28,12 +27,12 @@ func GetTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 
 	var code string
 	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+		logrus.Fatalf("Unable to read authorization code %v", err)
 	}
 
-	tok, err := config.Exchange(oauth2.NoContext, code)
+	tok, err := config.Exchange(context.Background(), code)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		logrus.Fatalf("Unable to retrieve token from web %v", err)
 	}
 	return tok
 }
@@ -73,42 +72,50 @@ func SaveToken(file string, token *oauth2.Token) {
 	fmt.Printf("Saving credential file to: %s\n", file)
 	f, err := os.Create(file)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		logrus.Fatalf("Unable to cache oauth token: %v", err)
 	}
 	defer f.Close()
 	json.NewEncoder(f).Encode(token)
 }
 
+// GetGmailClient authorizes with the cached oauth token of the user when
+// gmail-secret is given, otherwise with the resolved google credentials
 func GetGmailClient(c *cli.Context) (*gmail.Service, error) {
 	var srv *gmail.Service
-	cacheFile, err := TokenCacheFile(c)
-	if err != nil {
-		return srv, fmt.Errorf("error unable to set the token file path %s\n", err)
-	}
-	tok, err := TokenFromFile(cacheFile)
-	if err != nil {
-		return srv, fmt.Errorf("error unable to get token from cache file: possibly run the authorize-gmail command")
+	ctx := context.Background()
+	var ts oauth2.TokenSource
+	if c.String("gmail-secret") != "" {
+		cacheFile, err := TokenCacheFile(c)
+		if err != nil {
+			return srv, fmt.Errorf("error unable to set the token file path %s\n", err)
+		}
+		tok, err := TokenFromFile(cacheFile)
+		if err != nil {
+			return srv, fmt.Errorf("error unable to get token from cache file: possibly run the authorize-gmail command")
+		}
+		cont, err := ioutil.ReadFile(c.String("gmail-secret"))
+		if err != nil {
+			return srv, fmt.Errorf("error unable to read the secret json file %s\n", err)
+		}
+		config, err := google.ConfigFromJSON(cont, GmailScopes...)
+		if err != nil {
+			return srv, fmt.Errorf("error unable to create oauth config from secret file %s\n", err)
+		}
+		ts = config.TokenSource(ctx, tok)
+	} else {
+		sts, err := serviceTokenSource(ctx, c)
+		if err != nil {
+			return srv, err
+		}
+		ts = sts
 	}
-	cont, err := ioutil.ReadFile(c.String("gmail-secret"))
-	if err != nil {
-		return srv, fmt.Errorf("error unable to read the secret json file %s\n", err)
-	}
-	config, err := google.ConfigFromJSON(
-		cont,
-		gmail.GmailSendScope,
-		gmail.GmailComposeScope,
-		gmail.GmailLabelsScope,
-		gmail.GmailModifyScope,
-		gmail.MailGoogleComScope,
-	)
-	if err != nil {
-		return srv, fmt.Errorf("error unable to create oauth config from secret file %s\n", err)
-	}
-	client := config.Client(context.Background(), tok)
-	srv, err = gmail.New(client)
+	srv, err := gmail.New(oauth2.NewClient(ctx, ts))
 	if err != nil {
 		return srv, fmt.Errorf("error unable to set gmail client %s\n", err)
 	}
+	if c.IsSet("gmail-endpoint") {
+		srv.BasePath = c.String("gmail-endpoint")
+	}
 	return srv, nil
 }
 
@@ -121,6 +128,14 @@ func GetGithubClient(c *cli.Context) (*github.Client, error) {
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: string(tok)},
 	)
-	tc := oauth2.NewClient(oauth2.NoContext, ts)
-	return github.NewClient(tc), nil
+	tc := oauth2.NewClient(context.Background(), ts)
+	client = github.NewClient(tc)
+	if c.IsSet("github-endpoint") {
+		u, err := url.Parse(c.String("github-endpoint"))
+		if err != nil {
+			return client, fmt.Errorf("error in parsing github endpoint %s\n", err)
+		}
+		client.BaseURL = u
+	}
+	return client, nil
 }
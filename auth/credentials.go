@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// GmailScopes are requested by the gmail client, with the
+// oauth token of the user as well as with a service account
+var GmailScopes = []string{
+	gmail.GmailSendScope,
+	gmail.GmailComposeScope,
+	gmail.GmailLabelsScope,
+	gmail.GmailModifyScope,
+	gmail.MailGoogleComScope,
+}
+
+// KeyFile is the key-file flag of the command, or of the parent
+// command for sub commands that share the flag of their parent
+func KeyFile(c *cli.Context) string {
+	if file := c.String("key-file"); file != "" {
+		return file
+	}
+	return c.GlobalString("key-file")
+}
+
+// Credentials resolves the google credentials, in order, from the
+// key-file flag, the GOOGLE_APPLICATION_CREDENTIALS environment variable
+// and the application default credentials of gcloud or the metadata server
+func Credentials(ctx context.Context, c *cli.Context, scopes ...string) (*google.Credentials, error) {
+	file := KeyFile(c)
+	if file == "" {
+		creds, err := google.FindDefaultCredentials(ctx, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("error in finding credentials, either give a key-file or set GOOGLE_APPLICATION_CREDENTIALS %s\n", err)
+		}
+		return creds, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error in reading key file %s\n", err)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("error in parsing key file %s %s\n", file, err)
+	}
+	return creds, nil
+}
+
+// GetPubsubClient authorizes the pubsub client with the resolved credentials.
+// Against the emulator, when PUBSUB_EMULATOR_HOST is set, none are needed.
+func GetPubsubClient(ctx context.Context, c *cli.Context, project string) (*pubsub.Client, error) {
+	if os.Getenv("PUBSUB_EMULATOR_HOST") != "" {
+		return pubsub.NewClient(ctx, project)
+	}
+	creds, err := Credentials(ctx, c, pubsub.ScopePubSub)
+	if err != nil {
+		return nil, err
+	}
+	client, err := pubsub.NewClient(ctx, project, option.WithCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("error in making new cloud client %s\n", err)
+	}
+	return client, nil
+}
+
+// serviceTokenSource authorizes gmail with the resolved credentials. With
+// gmail-user the service account impersonates the user, that needs a key
+// and the domain-wide delegation of the gmail scopes.
+func serviceTokenSource(ctx context.Context, c *cli.Context) (oauth2.TokenSource, error) {
+	creds, err := Credentials(ctx, c, GmailScopes...)
+	if err != nil {
+		return nil, err
+	}
+	user := c.String("gmail-user")
+	if user == "" {
+		// gmail only accepts the token of a service account
+		// when it impersonates a user of the domain
+		if isServiceAccount(creds) {
+			return nil, fmt.Errorf("error in authorizing gmail: service account credentials need either gmail-user or gmail-secret\n")
+		}
+		return creds.TokenSource, nil
+	}
+	if len(creds.JSON) == 0 {
+		return nil, fmt.Errorf("error in impersonating %s: needs the json key of a service account\n", user)
+	}
+	conf, err := google.JWTConfigFromJSON(creds.JSON, GmailScopes...)
+	if err != nil {
+		return nil, fmt.Errorf("error in impersonating %s %s\n", user, err)
+	}
+	conf.Subject = user
+	return conf.TokenSource(ctx), nil
+}
+
+// isServiceAccount tells whether the credentials are of a service account,
+// either from a key file or from the metadata server, which has no json
+func isServiceAccount(creds *google.Credentials) bool {
+	if len(creds.JSON) == 0 {
+		return true
+	}
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(creds.JSON, &f); err != nil {
+		return false
+	}
+	return f.Type == "service_account"
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func writeKey(t *testing.T, email string) string {
+	file := filepath.Join(t.TempDir(), "key.json")
+	data := `{"type": "service_account", "client_email": "` + email + `", "private_key": "", "token_uri": "https://oauth2.googleapis.com/token"}`
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func newContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("credentials", flag.ContinueOnError)
+	set.String("key-file", "", "")
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestCredentials(t *testing.T) {
+	flagKey := writeKey(t, "flag@dictybase.iam.gserviceaccount.com")
+	envKey := writeKey(t, "env@dictybase.iam.gserviceaccount.com")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", envKey)
+	cases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"key file", []string{"--key-file", flagKey}, "flag@dictybase.iam.gserviceaccount.com"},
+		{"environment", nil, "env@dictybase.iam.gserviceaccount.com"},
+	}
+	for _, tc := range cases {
+		creds, err := Credentials(context.Background(), newContext(t, tc.args...), GmailScopes...)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+			continue
+		}
+		if !strings.Contains(string(creds.JSON), tc.want) {
+			t.Errorf("%s: got credentials %s, want the ones of %s", tc.name, creds.JSON, tc.want)
+		}
+	}
+	if _, err := Credentials(context.Background(), newContext(t, "--key-file", filepath.Join(t.TempDir(), "missing.json"))); err == nil {
+		t.Error("expected an error for a missing key file")
+	}
+}
+
+func TestIsServiceAccount(t *testing.T) {
+	cases := []struct {
+		name string
+		json string
+		want bool
+	}{
+		{"key file", `{"type": "service_account", "client_email": "orders@dictybase.iam.gserviceaccount.com"}`, true},
+		{"metadata server", ``, true},
+		{"gcloud login", `{"type": "authorized_user", "client_id": "id"}`, false},
+		{"unparsable", `{`, false},
+	}
+	for _, tc := range cases {
+		creds := &google.Credentials{JSON: []byte(tc.json)}
+		if got := isServiceAccount(creds); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
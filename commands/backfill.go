@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dictybase/gmail-webhook/auth"
+	"github.com/dictybase/gmail-webhook/handlers"
+	"github.com/dictybase/gmail-webhook/history"
+	"github.com/dictybase/gmail-webhook/labels"
+	"github.com/dictybase/gmail-webhook/logging"
+	"github.com/dictybase/gmail-webhook/mailbox"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const dateLayout = "2006-01-02"
+
+func ValidateBackfillOptions(c *cli.Context) error {
+	if !c.IsSet("label") {
+		return fmt.Errorf("missing command line argument %s\n", "label")
+	}
+	if c.Bool("dry-run") {
+		return nil
+	}
+	for _, v := range []string{"gh-token", "repository", "owner"} {
+		if !c.IsSet(v) {
+			return fmt.Errorf("missing command line argument %s\n", v)
+		}
+	}
+	return nil
+}
+
+// backfillQuery builds the gmail search query from the since
+// and until dates and the free form query
+func backfillQuery(c *cli.Context) (string, error) {
+	var terms []string
+	for _, v := range []struct{ flag, op string }{{"since", "after"}, {"until", "before"}} {
+		if !c.IsSet(v.flag) {
+			continue
+		}
+		t, err := time.Parse(dateLayout, c.String(v.flag))
+		if err != nil {
+			return "", fmt.Errorf("error in parsing %s date %s", v.flag, err)
+		}
+		terms = append(terms, fmt.Sprintf("%s:%s", v.op, t.Format("2006/01/02")))
+	}
+	if c.IsSet("query") {
+		terms = append(terms, c.String("query"))
+	}
+	return strings.Join(terms, " "), nil
+}
+
+// BackfillAction files the orders that arrived under the label before
+// the watch was set up. Messages go through the same issue generation as
+// the webhook and the ones the idempotency ledger knows are skipped.
+func BackfillAction(c *cli.Context) {
+	if err := ValidateBackfillOptions(c); err != nil {
+		logrus.Fatal(err)
+	}
+	query, err := backfillQuery(c)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	gmClient, err := auth.GetGmailClient(c)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	mb := mailbox.New(gmClient)
+	lm := labels.NewLabelManager(gmClient)
+	if err := lm.GenerateCache(); err != nil {
+		logrus.Fatalf("error in generating labels cache %s", err)
+	}
+	if !lm.HasLabel(c.String("label")) {
+		logrus.Fatalf("given label %s does not exist", c.String("label"))
+	}
+	hdb, err := history.NewHistoryDb(redisAddress(c))
+	if err != nil {
+		logrus.Fatalf("error in connecting to history db %s", err)
+	}
+	defer hdb.Close()
+	dsc := &handlers.DscClient{
+		Gmail:       gmClient,
+		Mailbox:     mb,
+		Label:       lm.Name2Id(c.String("label")),
+		Repository:  c.String("repository"),
+		Owner:       c.String("owner"),
+		HistoryDbh:  hdb,
+		TypeMatcher: orderTypeMatcher,
+		DryRun:      c.Bool("dry-run"),
+		OrderPrefix: c.String("order-prefix"),
+	}
+	if !dsc.DryRun {
+		ghClient, err := auth.GetGithubClient(c)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		dsc.Github = ghClient
+	}
+
+	ctx := context.Background()
+	ids, err := mb.List(ctx, dsc.Label, query)
+	if err != nil {
+		logrus.Fatalf("error in listing messages %s", err)
+	}
+	logrus.Infof("found %d messages under label %s matching %q", len(ids), c.String("label"), query)
+	var created, skipped, failed int
+	// gmail lists the newest message first, file the orders in the order they arrived
+	for i := len(ids) - 1; i >= 0; i-- {
+		mctx := logging.WithField(ctx, logging.GmailMessageID, ids[i])
+		logger := logging.FromContext(mctx)
+		msg, err := mb.Message(ctx, ids[i], mailbox.FormatFull)
+		if err != nil {
+			failed++
+			logger.Errorf("error in retrieving message %s", err)
+			continue
+		}
+		ok, err := dsc.ProcessMessage(mctx, msg)
+		switch {
+		case err != nil:
+			failed++
+		case ok:
+			created++
+		default:
+			skipped++
+		}
+	}
+	logrus.Infof("backfill created %d issues, skipped %d, failed %d", created, skipped, failed)
+	if failed > 0 {
+		logrus.Fatalf("%d messages failed to backfill", failed)
+	}
+}
@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/dictybase/gmail-webhook/config"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	configOnce sync.Once
+	configFile *config.Config
+	configErr  error
+)
+
+// requiredSettings are the settings of the config file that the commands
+// cannot do without, unless their flag is given. The other settings are
+// only checked when they are given.
+var requiredSettings = map[string][]string{
+	"run":      {"label", "github.owner", "github.repository"},
+	"backfill": {"label"},
+	"replay":   {"github.owner", "github.repository"},
+}
+
+// loadConfig reads the file of the global config flag once,
+// the config is nil if no file is given
+func loadConfig(c *cli.Context) (*config.Config, error) {
+	configOnce.Do(func() {
+		if file := c.GlobalString("config"); file != "" {
+			configFile, configErr = config.Load(file)
+		}
+	})
+	return configFile, configErr
+}
+
+// ApplyConfig fills in the global flags that are not given on the
+// command line, first from their GMAIL_WEBHOOK_ environment variable
+// and then from the config file
+func ApplyConfig(c *cli.Context) error {
+	return applyConfig(c, "", c.App.Flags)
+}
+
+// WithConfig applies the config to the flags of every
+// command and sub command before it runs
+func WithConfig(cmds []cli.Command) []cli.Command {
+	for i := range cmds {
+		cmd := cmds[i]
+		cmds[i].Before = func(c *cli.Context) error {
+			return applyConfig(c, cmd.Name, cmd.Flags)
+		}
+		cmds[i].Subcommands = WithConfig(cmds[i].Subcommands)
+	}
+	return cmds
+}
+
+func applyConfig(c *cli.Context, command string, flags []cli.Flag) error {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]string)
+	if cfg != nil {
+		var required []string
+		for _, key := range requiredSettings[command] {
+			flag := config.Flags[key]
+			if _, ok := os.LookupEnv(config.EnvName(flag)); !ok && !c.IsSet(flag) {
+				required = append(required, key)
+			}
+		}
+		if err := cfg.Validate(required...); err != nil {
+			return fmt.Errorf("invalid config file %s for %s\n%s", c.GlobalString("config"), command, err)
+		}
+		values = cfg.Values()
+	}
+	// the label of watch filters the notifications,
+	// it is not the label of the pipeline
+	if command == "watch" {
+		delete(values, "label")
+	}
+	for _, f := range flags {
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		if name == "config" || c.IsSet(name) {
+			continue
+		}
+		value, ok := os.LookupEnv(config.EnvName(name))
+		if !ok {
+			value, ok = values[name]
+		}
+		if !ok {
+			continue
+		}
+		if err := c.Set(name, value); err != nil {
+			return fmt.Errorf("error in setting %s to %q %s\n", name, value, err)
+		}
+	}
+	return nil
+}
+
+func ValidateConfigAction(c *cli.Context) {
+	file := c.GlobalString("config")
+	if file == "" {
+		logrus.Fatal("missing command line argument config")
+	}
+	if _, err := config.Load(file); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid\n", file)
+}
+
+// PrintConfigAction shows the settings of the config file and
+// the environment, flags on the command line override them
+func PrintConfigAction(c *cli.Context) {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FLAG\tVALUE\tSOURCE")
+	for _, s := range config.Resolve(cfg) {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Flag, s.Value, s.Source)
+	}
+	w.Flush()
+	if cfg != nil && len(cfg.Filters) > 0 {
+		fmt.Printf("\n%d filters, see filters sync --dry-run\n", len(cfg.Filters))
+	}
+}
@@ -0,0 +1,177 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dictybase/gmail-webhook/auth"
+	"github.com/dictybase/gmail-webhook/deadletter"
+	"github.com/dictybase/gmail-webhook/handlers"
+	"github.com/dictybase/gmail-webhook/history"
+	"github.com/dictybase/gmail-webhook/logging"
+	"github.com/dictybase/gmail-webhook/mailbox"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func redisAddress(c *cli.Context) string {
+	return fmt.Sprintf("%s:%d", c.String("redis-address"), c.Int("redis-port"))
+}
+
+// openDeadLetter returns the configured dead-letter store, it is nil if
+// the store is disabled. The redis store shares the pool of hdb.
+func openDeadLetter(c *cli.Context, hdb *history.HistoryDb) (deadletter.Store, error) {
+	switch kind := c.String("deadletter-store"); kind {
+	case "none":
+		return nil, nil
+	default:
+		return deadletter.New(kind, c.String("deadletter-dir"), hdb)
+	}
+}
+
+func mustOpenDeadLetter(c *cli.Context, hdb *history.HistoryDb) deadletter.Store {
+	store, err := openDeadLetter(c, hdb)
+	if err != nil {
+		logrus.Fatalf("error in opening dead-letter store %s", err)
+	}
+	if store == nil {
+		logrus.Fatal("dead-letter store is disabled")
+	}
+	return store
+}
+
+// mustBrowseDeadLetter opens the store for the list and show commands, only
+// the redis store connects to the history database. The returned function
+// closes the store and the database.
+func mustBrowseDeadLetter(c *cli.Context) (deadletter.Store, func()) {
+	if c.String("deadletter-store") == "file" {
+		store := mustOpenDeadLetter(c, nil)
+		return store, func() { store.Close() }
+	}
+	hdb := mustHistoryDb(c)
+	store := mustOpenDeadLetter(c, hdb)
+	return store, func() {
+		store.Close()
+		hdb.Close()
+	}
+}
+
+func ListDeadLetterAction(c *cli.Context) {
+	store, closeStore := mustBrowseDeadLetter(c)
+	defer closeStore()
+	entries, err := store.List()
+	if err != nil {
+		logrus.Fatalf("error in listing dead-letter entries %s", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MESSAGE\tATTEMPTS\tLAST FAILED\tERROR")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", e.ID, e.Attempts, e.LastFailed.Format(time.RFC3339), e.Error)
+	}
+	w.Flush()
+}
+
+func ShowDeadLetterAction(c *cli.Context) {
+	if !c.Args().Present() {
+		logrus.Fatal("missing argument message id")
+	}
+	store, closeStore := mustBrowseDeadLetter(c)
+	defer closeStore()
+	e, err := store.Get(c.Args().First())
+	if err != nil {
+		logrus.Fatalf("error in retrieving dead-letter entry %s", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(e)
+}
+
+// ReplayDeadLetterAction runs the stored messages through the same
+// pipeline again, entries are removed once their issue is created
+func ReplayDeadLetterAction(c *cli.Context) {
+	if !c.Args().Present() && !c.Bool("all") {
+		logrus.Fatal("missing argument message id or the all flag")
+	}
+	for _, v := range []string{"gh-token", "repository", "owner"} {
+		if !c.IsSet(v) {
+			logrus.Fatalf("missing command line argument %s", v)
+		}
+	}
+	hdb := mustHistoryDb(c)
+	defer hdb.Close()
+	store := mustOpenDeadLetter(c, hdb)
+	defer store.Close()
+	var entries []*deadletter.Entry
+	if c.Bool("all") {
+		all, err := store.List()
+		if err != nil {
+			logrus.Fatalf("error in listing dead-letter entries %s", err)
+		}
+		entries = all
+	} else {
+		for _, id := range c.Args() {
+			e, err := store.Get(id)
+			if err != nil {
+				logrus.Fatalf("error in retrieving dead-letter entry %s %s", id, err)
+			}
+			entries = append(entries, e)
+		}
+	}
+	ghClient, err := auth.GetGithubClient(c)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	dsc := &handlers.DscClient{
+		HistoryDbh:  hdb,
+		Github:      ghClient,
+		Repository:  c.String("repository"),
+		Owner:       c.String("owner"),
+		TypeMatcher: orderTypeMatcher,
+		OrderPrefix: c.String("order-prefix"),
+	}
+	var failed int
+	for _, e := range entries {
+		logger := logrus.WithField(logging.GmailMessageID, e.ID)
+		// messages that could not be retrieved are only kept by their id
+		if e.Message.Payload == nil {
+			if dsc.Mailbox == nil {
+				gmClient, err := auth.GetGmailClient(c)
+				if err != nil {
+					logrus.Fatal(err)
+				}
+				dsc.Gmail = gmClient
+				dsc.Mailbox = mailbox.New(gmClient)
+			}
+			msg, err := dsc.Mailbox.Message(context.Background(), e.ID, mailbox.FormatFull)
+			if err != nil {
+				failed++
+				if _, err := store.Add(e.Message, err); err != nil {
+					logger.Errorf("error in updating dead-letter entry %s", err)
+				}
+				logger.Errorf("replay failed %s", err)
+				continue
+			}
+			e.Message = msg
+		}
+		if _, err := dsc.ProcessMessage(context.Background(), e.Message); err != nil {
+			failed++
+			if _, err := store.Add(e.Message, err); err != nil {
+				logger.Errorf("error in updating dead-letter entry %s", err)
+			}
+			logger.Errorf("replay failed %s", err)
+			continue
+		}
+		if err := store.Delete(e.ID); err != nil {
+			logger.Errorf("error in removing replayed dead-letter entry %s", err)
+		}
+		logger.Info("replayed message")
+	}
+	if failed > 0 {
+		logrus.Fatalf("%d of %d messages failed to replay", failed, len(entries))
+	}
+	logrus.Infof("replayed %d messages", len(entries))
+}
@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dictybase/gmail-webhook/deadletter"
+	"github.com/dictybase/gmail-webhook/history"
+	"github.com/dictybase/gmail-webhook/testing/fake"
+	"google.golang.org/api/gmail/v1"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// writeFile puts the content in a file of the test directory
+func writeFile(t *testing.T, dir, name, content string) string {
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// replayContext has the flags of deadletter replay, gmail is
+// authorized with a cached oauth token that never expires
+func replayContext(t *testing.T, rd *miniredis.Miniredis, g *fake.Gmail, gh *fake.Github) *cli.Context {
+	dir := t.TempDir()
+	set := flag.NewFlagSet("replay", flag.ContinueOnError)
+	args := []string{"--all", "--redis-port", rd.Port()}
+	for name, value := range map[string]string{
+		"deadletter-store": "redis",
+		"redis-address":    rd.Host(),
+		"gh-token":         writeFile(t, dir, "gh-token", "token"),
+		"owner":            "dictybase",
+		"repository":       "orders",
+		"github-endpoint":  gh.BaseURL(),
+		"gmail-endpoint":   g.BasePath(),
+		"gmail-secret": writeFile(t, dir, "secret.json", `{"installed":{"client_id":"id","client_secret":"secret",`+
+			`"token_uri":"https://oauth2.googleapis.com/token","redirect_uris":["urn:ietf:wg:oauth:2.0:oob"]}}`),
+		"cache-file":   writeFile(t, dir, "gmail.json", `{"access_token":"token","expiry":"2099-01-01T00:00:00Z"}`),
+		"order-prefix": "DSC",
+	} {
+		set.String(name, "", "")
+		args = append(args, "--"+name, value)
+	}
+	set.String("deadletter-dir", "", "")
+	set.Int("redis-port", 0, "")
+	set.Bool("all", false, "")
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	g := fake.NewGmail()
+	t.Cleanup(g.Close)
+	gh := fake.NewGithub()
+	t.Cleanup(gh.Close)
+	rd := miniredis.RunT(t)
+	hdb, err := history.NewHistoryDb(rd.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hdb.Close() })
+
+	order := func(id, subject, body string) *gmail.Message {
+		return &gmail.Message{
+			Id:       id,
+			ThreadId: id,
+			Payload: &gmail.MessagePart{
+				MimeType: "text/plain",
+				Headers:  []*gmail.MessagePartHeader{{Name: "Subject", Value: subject}},
+				Body:     &gmail.MessagePartBody{Data: encode(body)},
+			},
+		}
+	}
+	// m2 could not be retrieved, it is only kept by its id
+	g.AddMessage(order("m2", "Plasmid order", "Order_Type:none|plasmid"))
+	store := deadletter.NewRedisStore(hdb)
+	for _, msg := range []*gmail.Message{order("m1", "Stock order", "Order_Type:strain|none"), {Id: "m2"}} {
+		if _, err := store.Add(msg, errors.New("github is down")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ReplayDeadLetterAction(replayContext(t, rd, g, gh))
+	if n := len(gh.Issues("dictybase", "orders")); n != 2 {
+		t.Errorf("got %d issues after the replay, want 2", n)
+	}
+	entries, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d entries after the replay, want none", len(entries))
+	}
+	// the store shares the pool, the history database is still open
+	if err := hdb.Ping(); err != nil {
+		t.Errorf("history database is closed after the replay %s", err)
+	}
+}
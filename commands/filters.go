@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dictybase/gmail-webhook/filters"
+	"github.com/dictybase/gmail-webhook/labels"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func ListFiltersAction(c *cli.Context) {
+	lm := mustLabelManager(c)
+	fl, err := filters.NewManager(lm.Client).List()
+	if err != nil {
+		logrus.Fatalf("error in listing filters %s", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADD LABELS\tCRITERIA")
+	for _, f := range fl {
+		var names []string
+		if f.Action != nil {
+			for _, id := range f.Action.AddLabelIds {
+				names = append(names, lm.Id2Name(id))
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.Id, strings.Join(names, ","), filters.Describe(f))
+	}
+	w.Flush()
+}
+
+// SyncFiltersAction creates the filters declared in the config file that do
+// not exist yet. With prune, the undeclared filters that add one of the
+// declared labels are deleted. Running it again without changes is a no-op.
+func SyncFiltersAction(c *cli.Context) {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if cfg == nil {
+		logrus.Fatal("missing global command line argument config")
+	}
+	if c.IsSet("label") {
+		cfg.Label = c.String("label")
+	}
+	lm := mustLabelManager(c)
+	declared := make(map[string]*gmail.Filter)
+	var managed []string
+	for _, f := range cfg.Filters {
+		name := cfg.FilterLabel(f)
+		label, err := lm.Lookup(name)
+		if err == labels.ErrNotFound && c.Bool("create-label") && !c.Bool("dry-run") {
+			label, err = lm.EnsureLabel(name, labels.Options{})
+		}
+		if err != nil {
+			logrus.Fatalf("error in looking up label %s of filter %s %s", name, f.Name, err)
+		}
+		declared[f.Name] = f.Gmail(label.Id)
+		managed = append(managed, label.Id)
+	}
+	fm := filters.NewManager(lm.Client)
+	changes, err := fm.Plan(declared, managed, c.Bool("prune"))
+	if err != nil {
+		logrus.Fatalf("error in listing filters %s", err)
+	}
+	if len(changes) == 0 {
+		logrus.Info("filters are in sync")
+		return
+	}
+	for _, ch := range changes {
+		verb := "delete"
+		if ch.Create {
+			verb = "create"
+		}
+		logrus.Infof("%s filter %s: %s", verb, ch.Name, filters.Describe(ch.Filter))
+	}
+	if c.Bool("dry-run") {
+		return
+	}
+	if err := fm.Apply(changes); err != nil {
+		logrus.Fatalf("error in syncing filters %s", err)
+	}
+	logrus.Infof("synced %d filters", len(changes))
+}
+
+func DeleteFilterAction(c *cli.Context) {
+	if !c.Args().Present() {
+		logrus.Fatal("missing argument filter id")
+	}
+	lm := mustLabelManager(c)
+	fm := filters.NewManager(lm.Client)
+	for _, id := range c.Args() {
+		if err := fm.Delete(id); err != nil {
+			logrus.Fatalf("error in deleting filter %s %s", id, err)
+		}
+		logrus.Infof("deleted filter %s", id)
+	}
+}
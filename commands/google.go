@@ -1,27 +1,35 @@
 package commands
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"cloud.google.com/go/pubsub"
 	"github.com/dictybase/gmail-webhook/auth"
 	"github.com/dictybase/gmail-webhook/history"
-	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
+	"github.com/dictybase/gmail-webhook/labels"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
-	"google.golang.org/cloud"
-	"google.golang.org/cloud/pubsub"
-	"gopkg.in/codegangsta/cli.v1"
+	"gopkg.in/urfave/cli.v1"
 )
 
 func ValidateWatchOptions(c *cli.Context) error {
-	for _, v := range []string{"topic", "project", "gmail-secret"} {
+	for _, v := range []string{"topic", "project"} {
 		if !c.IsSet(v) {
 			return fmt.Errorf("missing command line argument %s\n", v)
 		}
 	}
+	switch c.String("label-filter-action") {
+	case "include", "exclude":
+	default:
+		return fmt.Errorf("unknown label-filter-action %s, should be either include or exclude\n", c.String("label-filter-action"))
+	}
 	return nil
 }
 
@@ -33,7 +41,7 @@ func ValidateGmailOptions(c *cli.Context) error {
 }
 
 func ValidateSubOptions(c *cli.Context) error {
-	for _, v := range []string{"topic", "name", "endpoint", "key-file", "project-id"} {
+	for _, v := range []string{"topic", "name", "endpoint", "project-id"} {
 		if !c.IsSet(v) {
 			return fmt.Errorf("missing command line argument %s\n", v)
 		}
@@ -41,92 +49,181 @@ func ValidateSubOptions(c *cli.Context) error {
 	return nil
 }
 
-func DoAuthorization(c *cli.Context) (oauth2.TokenSource, error) {
-	var ts oauth2.TokenSource
-	jsonKey, err := ioutil.ReadFile(c.GlobalString("key-file"))
+func SubscribeAction(c *cli.Context) {
+	if err := ValidateSubOptions(c); err != nil {
+		logrus.Fatal(err)
+	}
+	ctx := context.Background()
+	client, err := auth.GetPubsubClient(ctx, c, c.String("project-id"))
 	if err != nil {
-		return ts, err
+		logrus.Fatal(err)
 	}
-	conf, err := google.JWTConfigFromJSON(jsonKey, pubsub.ScopePubSub)
+	defer client.Close()
+	sh, err := client.CreateSubscription(ctx, c.String("name"), pubsub.SubscriptionConfig{
+		Topic:      client.Topic(c.String("topic")),
+		PushConfig: pubsub.PushConfig{Endpoint: c.String("endpoint")},
+	})
 	if err != nil {
-		return ts, err
+		logrus.Fatalf("error in creating subscription %s", err)
 	}
-	return conf.TokenSource(context.Background()), nil
+	logrus.Infof("created subscription %s", sh.String())
 }
 
-func SubscribeAction(c *cli.Context) {
-	if err := ValidateSubOptions(c); err != nil {
-		log.Fatal(err)
+// StopWatchAction stops the push notifications of the mailbox
+func StopWatchAction(c *cli.Context) {
+	histDb, err := history.NewHistoryDb(redisAddress(c))
+	if err != nil {
+		logrus.Fatalf("error in connecting to redis database %s", err)
 	}
-	ts, err := DoAuthorization(c)
+	defer histDb.Close()
+	gm, err := auth.GetGmailClient(c)
 	if err != nil {
-		log.Fatal(err)
+		logrus.Fatal(err)
+	}
+	if err := gm.Users.Stop("me").Do(); err != nil {
+		logrus.Fatalf("error in stopping watch %s", err)
+	}
+	if err := histDb.DeleteWatchExpiration(); err != nil {
+		logrus.Fatalf("error in removing watch expiration from redis %s", err)
 	}
-	client, err := pubsub.NewClient(context.Background(), c.GlobalString("project-id"), cloud.WithTokenSource(ts))
+	logrus.Info("stopped the gmail watch")
+}
+
+// WatchStatusAction shows the stored watch expiration and history ids
+// next to the current history id of the mailbox, the difference between
+// them is how far behind the processing is
+func WatchStatusAction(c *cli.Context) {
+	histDb, err := history.NewHistoryDb(redisAddress(c))
+	if err != nil {
+		logrus.Fatalf("error in connecting to redis database %s", err)
+	}
+	defer histDb.Close()
+	gm, err := auth.GetGmailClient(c)
 	if err != nil {
-		log.Fatalf("error in making new cloud client %s\n", err)
+		logrus.Fatal(err)
 	}
-	th := client.Topic(c.String("topic"))
-	sh, err := th.Subscribe(context.Background(), c.String("name"), 0, &pubsub.PushConfig{Endpoint: c.String("endpoint")})
+	profile, err := gm.Users.GetProfile("me").Do()
 	if err != nil {
-		log.Fatalf("error in creating subscription %s\n", err)
+		logrus.Fatalf("error in retrieving gmail profile %s", err)
 	}
-	log.Printf("created subscription %s\n", sh.Name())
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "mailbox\t%s\n", profile.EmailAddress)
+	ok, err := histDb.HasWatchExpiration()
+	if err != nil {
+		logrus.Fatalf("error in reading watch expiration %s", err)
+	}
+	if ok {
+		exp, err := histDb.GetWatchExpiration()
+		if err != nil {
+			logrus.Fatalf("error in reading watch expiration %s", err)
+		}
+		state := "expires in " + (time.Until(exp) / time.Second * time.Second).String()
+		if time.Now().After(exp) {
+			state = "expired"
+		}
+		fmt.Fprintf(w, "watch expiration\t%s (%s)\n", exp.Format(time.RFC3339), state)
+	} else {
+		fmt.Fprintln(w, "watch expiration\tnot watching")
+	}
+	if ok, err := histDb.HasStartHistory(); err == nil && ok {
+		start, err := histDb.GetStartHistory()
+		if err != nil {
+			logrus.Fatalf("error in reading start history %s", err)
+		}
+		fmt.Fprintf(w, "start history\t%d\n", start)
+	}
+	fmt.Fprintf(w, "mailbox history\t%d\n", profile.HistoryId)
+	ok, err = histDb.HasCurrentHistory()
+	if err != nil {
+		logrus.Fatalf("error in reading current history %s", err)
+	}
+	if !ok {
+		fmt.Fprintln(w, "current history\tnone")
+		return
+	}
+	current, err := histDb.GetCurrentHistory()
+	if err != nil {
+		logrus.Fatalf("error in reading current history %s", err)
+	}
+	fmt.Fprintf(w, "current history\t%d\n", current)
+	behind := int64(profile.HistoryId) - int64(current)
+	if behind < 0 {
+		behind = 0
+	}
+	fmt.Fprintf(w, "behind\t%d history records\n", behind)
 }
 
 func AuthGmailAction(c *cli.Context) {
 	if err := ValidateGmailOptions(c); err != nil {
-		log.Fatal(err)
+		logrus.Fatal(err)
 	}
 	tokenFile, err := auth.TokenCacheFile(c)
 	if err != nil {
-		log.Fatalf("error unable to set the token file path %s\n", err)
+		logrus.Fatalf("error unable to set the token file path %s", err)
 	}
 	cont, err := ioutil.ReadFile(c.String("gmail-secret"))
 	if err != nil {
-		log.Fatalf("error unable to read the secret json file %s\n", err)
+		logrus.Fatalf("error unable to read the secret json file %s", err)
 	}
-	config, err := google.ConfigFromJSON(
-		cont,
-		gmail.GmailSendScope,
-		gmail.GmailComposeScope,
-		gmail.GmailLabelsScope,
-		gmail.GmailModifyScope,
-		gmail.MailGoogleComScope,
-	)
+	config, err := google.ConfigFromJSON(cont, auth.GmailScopes...)
 	if err != nil {
-		log.Fatalf("error unable to create oauth config from secret file %s\n", err)
+		logrus.Fatalf("error unable to create oauth config from secret file %s", err)
 	}
 	tok := auth.GetTokenFromWeb(config)
 	auth.SaveToken(tokenFile, tok)
-	log.Printf("saved gmail token to %s file\n", tokenFile)
+	logrus.Infof("saved gmail token to %s file", tokenFile)
 }
 
 func WatchGmailAction(c *cli.Context) {
 	if err := ValidateWatchOptions(c); err != nil {
-		log.Fatal(err)
+		logrus.Fatal(err)
 	}
 	histDb, err := history.NewHistoryDb(fmt.Sprintf("%s:%d", c.String("redis-address"), c.Int("redis-port")))
 	if err != nil {
-		log.Fatalf("error in connecting to redis database %s\n", err)
+		logrus.Fatalf("error in connecting to redis database %s", err)
 	}
+	defer histDb.Close()
 	gm, err := auth.GetGmailClient(c)
 	if err != nil {
-		log.Fatal(err)
+		logrus.Fatal(err)
 	}
-	resp, err := gmail.NewUsersService(gm).Watch(
-		"me",
-		&gmail.WatchRequest{
-			TopicName: fmt.Sprintf("projects/%s/topics/%s", c.String("project"), c.String("topic")),
-		},
-	).Do()
-	if err != nil {
-		log.Fatalf("error in executing watch call %s\n", err)
+	req := &gmail.WatchRequest{
+		TopicName: fmt.Sprintf("projects/%s/topics/%s", c.String("project"), c.String("topic")),
 	}
-	log.Printf("sucessful watch call with expiration %d and history %d\n", resp.Expiration, resp.HistoryId)
-	err = histDb.AddStartHistory(resp.HistoryId)
+	if c.IsSet("label") {
+		lm := labels.NewLabelManager(gm)
+		if err := lm.GenerateCache(); err != nil {
+			logrus.Fatalf("error in generating labels cache %s", err)
+		}
+		for _, name := range strings.Split(c.String("label"), ",") {
+			l, err := lm.Lookup(name)
+			if err != nil {
+				logrus.Fatalf("error in looking up label %s %s", name, err)
+			}
+			req.LabelIds = append(req.LabelIds, l.Id)
+		}
+		req.LabelFilterAction = c.String("label-filter-action")
+	}
+	if err := watchGmail(gm, histDb, req); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// watchGmail starts or renews the watch of the mailbox and stores its
+// history id, the processing starts from it unless it has a cursor already
+func watchGmail(gm *gmail.Service, histDb *history.HistoryDb, req *gmail.WatchRequest) error {
+	resp, err := gmail.NewUsersService(gm).Watch("me", req).Do()
 	if err != nil {
-		log.Fatalf("error in adding start history in redis %s\n", err)
+		return fmt.Errorf("error in executing watch call %s", err)
+	}
+	logrus.Infof("sucessful watch call with expiration %d and history %d", resp.Expiration, resp.HistoryId)
+	if err := histDb.AddStartHistory(resp.HistoryId); err != nil {
+		return fmt.Errorf("error in adding start history in redis %s", err)
 	}
-	log.Printf("added start history %d in redis\n", resp.HistoryId)
+	logrus.Infof("added start history %d in redis", resp.HistoryId)
+	if err := histDb.SetWatchExpiration(resp.Expiration); err != nil {
+		return fmt.Errorf("error in adding watch expiration in redis %s", err)
+	}
+	return nil
 }
@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/dictybase/gmail-webhook/auth"
+	"github.com/dictybase/gmail-webhook/labels"
+	"github.com/dictybase/gmail-webhook/mailbox"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func mustLabelManager(c *cli.Context) *labels.LabelManager {
+	gmClient, err := auth.GetGmailClient(c)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	lm := labels.NewLabelManager(gmClient)
+	if err := lm.GenerateCache(); err != nil {
+		logrus.Fatalf("error in generating labels cache %s", err)
+	}
+	return lm
+}
+
+func ListLabelsAction(c *cli.Context) {
+	lm := mustLabelManager(c)
+	ll := lm.Labels()
+	sort.Slice(ll, func(i, j int) bool { return ll[i].Name < ll[j].Name })
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTYPE")
+	for _, l := range ll {
+		if l.Type == "system" && !c.Bool("all") {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", l.Id, l.Name, l.Type)
+	}
+	w.Flush()
+}
+
+func CreateLabelAction(c *cli.Context) {
+	if !c.Args().Present() {
+		logrus.Fatal("missing argument label name")
+	}
+	lm := mustLabelManager(c)
+	name := c.Args().First()
+	if lm.HasLabel(name) {
+		logrus.Fatalf("label %s already exists", name)
+	}
+	l, err := lm.EnsureLabel(name, labels.Options{
+		LabelListVisibility:   c.String("label-visibility"),
+		MessageListVisibility: c.String("message-visibility"),
+		BackgroundColor:       c.String("background-color"),
+		TextColor:             c.String("text-color"),
+	})
+	if err != nil {
+		logrus.Fatalf("error in creating label %s %s", name, err)
+	}
+	logrus.Infof("created label %s with id %s", l.Name, l.Id)
+}
+
+func RenameLabelAction(c *cli.Context) {
+	if c.NArg() != 2 {
+		logrus.Fatal("need the current and the new label name as arguments")
+	}
+	lm := mustLabelManager(c)
+	l, err := lm.Rename(c.Args().Get(0), c.Args().Get(1))
+	if err != nil {
+		logrus.Fatalf("error in renaming label %s %s", c.Args().Get(0), err)
+	}
+	logrus.Infof("renamed label %s to %s", c.Args().Get(0), l.Name)
+}
+
+func DeleteLabelAction(c *cli.Context) {
+	if !c.Args().Present() {
+		logrus.Fatal("missing argument label name")
+	}
+	lm := mustLabelManager(c)
+	if err := lm.Delete(c.Args().First()); err != nil {
+		logrus.Fatalf("error in deleting label %s %s", c.Args().First(), err)
+	}
+	logrus.Infof("deleted label %s", c.Args().First())
+}
+
+// ApplyLabelAction adds the label to every message matching the gmail
+// search query, or removes it from them
+func ApplyLabelAction(c *cli.Context) {
+	if !c.Args().Present() {
+		logrus.Fatal("missing argument label name")
+	}
+	if !c.IsSet("query") {
+		logrus.Fatal("missing command line argument query")
+	}
+	lm := mustLabelManager(c)
+	name := c.Args().First()
+	if !lm.HasLabel(name) {
+		logrus.Fatalf("given label %s does not exist", name)
+	}
+	ids, err := mailbox.New(lm.Client).List(context.Background(), "", c.String("query"))
+	if err != nil {
+		logrus.Fatalf("error in listing messages %s", err)
+	}
+	if c.Bool("dry-run") {
+		logrus.Infof("would change label %s of %d messages matching %q", name, len(ids), c.String("query"))
+		return
+	}
+	if err := lm.Apply(name, ids, c.Bool("remove")); err != nil {
+		logrus.Fatalf("error in changing label %s %s", name, err)
+	}
+	if c.Bool("remove") {
+		logrus.Infof("removed label %s from %d messages", name, len(ids))
+		return
+	}
+	logrus.Infof("applied label %s to %d messages", name, len(ids))
+}
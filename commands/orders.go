@@ -0,0 +1,60 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dictybase/gmail-webhook/history"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func mustHistoryDb(c *cli.Context) *history.HistoryDb {
+	hdb, err := history.NewHistoryDb(redisAddress(c))
+	if err != nil {
+		logrus.Fatalf("error in connecting to history db %s", err)
+	}
+	return hdb
+}
+
+func ListOrdersAction(c *cli.Context) {
+	hdb := mustHistoryDb(c)
+	defer hdb.Close()
+	orders, err := hdb.ListOrders()
+	if err != nil {
+		logrus.Fatalf("error in listing orders %s", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ORDER\tCREATED\tMESSAGE\tISSUE")
+	for _, o := range orders {
+		if !strings.HasPrefix(o.ID, c.String("prefix")) {
+			continue
+		}
+		issue := "(none)"
+		if o.Issue != 0 {
+			issue = fmt.Sprintf("%s#%d", o.Repository, o.Issue)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", o.ID, o.Created.Format(time.RFC3339), o.MessageID, issue)
+	}
+	w.Flush()
+}
+
+// ShowOrderAction looks the order up by its order id or gmail message id
+func ShowOrderAction(c *cli.Context) {
+	if !c.Args().Present() {
+		logrus.Fatal("missing argument order id")
+	}
+	hdb := mustHistoryDb(c)
+	defer hdb.Close()
+	o, err := hdb.GetOrder(c.Args().First())
+	if err != nil {
+		logrus.Fatalf("error in retrieving order %s %s", c.Args().First(), err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(o)
+}
@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/dictybase/gmail-webhook/auth"
+	"github.com/dictybase/gmail-webhook/handlers"
+	"github.com/dictybase/gmail-webhook/mailbox"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// PreviewAction prints the issue that would be created for a
+// gmail message, neither github nor the history cursor is touched
+func PreviewAction(c *cli.Context) {
+	if !c.Args().Present() {
+		logrus.Fatal("missing argument message id")
+	}
+	gmClient, err := auth.GetGmailClient(c)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	msg, err := mailbox.New(gmClient).Message(context.Background(), c.Args().First(), mailbox.FormatFull)
+	if err != nil {
+		logrus.Fatalf("error in retrieving message %s", err)
+	}
+	dsc := &handlers.DscClient{
+		Gmail:       gmClient,
+		Repository:  c.String("repository"),
+		Owner:       c.String("owner"),
+		TypeMatcher: orderTypeMatcher,
+		OrderPrefix: c.String("order-prefix"),
+	}
+	p, err := dsc.PreviewMessage(msg)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(p)
+}
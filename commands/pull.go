@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/dictybase/gmail-webhook/auth"
+	"github.com/dictybase/gmail-webhook/failure"
+	"github.com/dictybase/gmail-webhook/handlers"
+	"github.com/dictybase/gmail-webhook/logging"
+	"github.com/dictybase/gmail-webhook/metrics"
+	"github.com/dictybase/gmail-webhook/middlewares"
+	"github.com/dictybase/gmail-webhook/tracing"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// runPuller pulls gmail notifications from the subscription and runs them
+// through the same pipeline as the push handler. Messages are acknowledged
+// once processed or when they failed permanently, transient failures are
+// left for redelivery. The ack deadline of the message being processed is
+// extended by the client up to the max-extension duration.
+//
+// Pulling stops once the stop context is done, the message in progress is
+// still processed with the work context.
+func runPuller(stop, work context.Context, c *cli.Context, dsc *handlers.DscClient) error {
+	client, err := auth.GetPubsubClient(work, c, c.String("project"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	sub := client.Subscription(c.String("subscription"))
+	sub.ReceiveSettings.MaxExtension = c.Duration("max-extension")
+	// a single message in flight at a time
+	sub.ReceiveSettings.Synchronous = true
+	sub.ReceiveSettings.NumGoroutines = 1
+	sub.ReceiveSettings.MaxOutstandingMessages = 1
+	logrus.Infof("pulling notifications from subscription %s", c.String("subscription"))
+	// Receive returns once stop is done and the message in progress is handled
+	err = sub.Receive(stop, func(_ context.Context, m *pubsub.Message) {
+		metrics.NotificationsReceived.WithLabelValues(handlers.Pipeline, "pull").Inc()
+		start := time.Now()
+		ctx := logging.WithField(work, logging.PubsubMessageID, m.ID)
+		ctx, span := tracing.Start(
+			tracing.Extract(ctx, propagation.MapCarrier(m.Attributes)),
+			"pubsub pull",
+			attribute.String("messaging.message.id", m.ID),
+		)
+		logger := logging.FromContext(ctx)
+		var attempt int
+		if m.DeliveryAttempt != nil {
+			attempt = *m.DeliveryAttempt
+			logger.Debugf("delivery attempt %d", attempt)
+		}
+		ctx = middlewares.WithDelivery(ctx, m.PublishTime, attempt)
+		msg, err := dsc.HandleNotification(ctx, m.Data)
+		tracing.End(span, err)
+		switch {
+		case err == nil:
+			logger.Infof("processed message in %s: %s", time.Since(start), msg)
+			m.Ack()
+		case failure.IsPermanent(err):
+			logger.Errorf("acknowledging message with permanent error %s", err)
+			m.Ack()
+		default:
+			logger.Warnf("leaving message for redelivery %s", err)
+			m.Nack()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error in receiving messages %s", err)
+	}
+	return nil
+}
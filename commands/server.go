@@ -1,114 +1,264 @@
 package commands
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"strings"
+	"syscall"
 
-	"golang.org/x/net/context"
-
-	"github.com/cyclopsci/apollo"
 	"github.com/dictybase/gmail-webhook/auth"
 	"github.com/dictybase/gmail-webhook/handlers"
 	"github.com/dictybase/gmail-webhook/history"
 	"github.com/dictybase/gmail-webhook/labels"
+	"github.com/dictybase/gmail-webhook/mailbox"
+	"github.com/dictybase/gmail-webhook/metrics"
 	"github.com/dictybase/gmail-webhook/middlewares"
-	"gopkg.in/codegangsta/cli.v1"
+	"github.com/dictybase/gmail-webhook/reply"
+	"github.com/dictybase/gmail-webhook/tracing"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
 )
 
+// orderTypeMatcher extracts the order type from the body of an order email
+var orderTypeMatcher = regexp.MustCompile(`Order_Type:(\w+)\|(\w+)`)
+
 func ValidateServerOptions(c *cli.Context) error {
-	for _, v := range []string{"subscription", "project", "gmail-secret", "gh-token"} {
+	for _, v := range []string{"subscription", "project", "gh-token", "label", "repository", "owner"} {
 		if !c.IsSet(v) {
 			return fmt.Errorf("missing command line argument %s\n", v)
 		}
 	}
+	switch c.String("mode") {
+	case "push", "pull":
+	default:
+		return fmt.Errorf("unknown mode %s, should be either push or pull\n", c.String("mode"))
+	}
+	if c.Bool("reply") && c.Int("reply-limit") > 0 && c.Duration("reply-window") <= 0 {
+		return fmt.Errorf("reply-window has to be positive with a reply-limit\n")
+	}
+	for _, t := range triggers(c) {
+		if t != mailbox.MessageAdded && t != mailbox.LabelAdded {
+			return fmt.Errorf("unknown trigger %s, should be either %s or %s\n", t, mailbox.MessageAdded, mailbox.LabelAdded)
+		}
+	}
 	return nil
 }
 
-func RunServer(c *cli.Context) {
+// triggers splits the comma separated history types of the trigger flag
+func triggers(c *cli.Context) []string {
+	var types []string
+	for _, t := range strings.Split(c.String("trigger"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func RunServer(c *cli.Context) error {
 	if err := ValidateServerOptions(c); err != nil {
-		log.Fatal(err)
+		return err
 	}
-	var logMw *middlewares.Logger
-	if c.IsSet("log") {
-		w, err := os.Create(c.String("log"))
-		if err != nil {
-			log.Fatalf("cannot open log file %q\n", err)
-		}
-		defer w.Close()
-		logMw = middlewares.NewFileLogger(w)
-	} else {
-		logMw = middlewares.NewLogger()
+	return runServer(c)
+}
+
+// runServer returns instead of exiting, so that the traces and the redis
+// pool are flushed by its deferred calls and the log file by app.After
+func runServer(c *cli.Context) error {
+	shutdownTracing, err := tracing.Setup(
+		context.Background(),
+		c.String("trace-exporter"),
+		c.String("trace-endpoint"),
+		c.String("trace-file"),
+	)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Duration("shutdown-timeout"))
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logrus.Errorf("error in flushing traces %s", err)
+		}
+	}()
 	gmClient, err := auth.GetGmailClient(c)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	ghClient, err := auth.GetGithubClient(c)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	mux := http.NewServeMux()
-	valMw := &middlewares.GmailSubscription{
-		fmt.Sprintf(
-			"projects/%s/subscriptions/%s",
-			c.String("project"),
-			c.String("subscription"),
-		),
-	}
-	hdb, err := history.NewHistoryDb(
-		fmt.Sprintf(
-			"%s:%d",
-			c.String("redis-address"),
-			c.Int("redis-port"),
-		),
-	)
+	hdb, err := history.NewHistoryDb(redisAddress(c))
 	if err != nil {
-		log.Fatalf("error in connecting to history db %s\n", err)
+		return fmt.Errorf("error in connecting to history db %s\n", err)
 	}
+	defer hdb.Close()
 
 	lm := labels.NewLabelManager(gmClient)
+	lm.MaxAge = c.Duration("label-max-age")
 	err = lm.GenerateCache()
 	if err != nil {
-		log.Fatalf("error in generating labels cache %s\n", err)
-	}
-	if !lm.HasLabel(c.String("label")) {
-		log.Fatalf("given label %s does not exist\n", c.String("label"))
+		return fmt.Errorf("error in generating labels cache %s\n", err)
 	}
-
-	logger := log.New(os.Stderr, "gmail-webhook", log.Lshortfile)
-	if c.IsSet("app-log") {
-		l, err := os.Create(c.String("app-log"))
+	label, err := lm.Lookup(c.String("label"))
+	switch {
+	case err == labels.ErrNotFound && c.Bool("create-label"):
+		label, err = lm.EnsureLabel(c.String("label"), labels.Options{})
 		if err != nil {
-			log.Fatalf("error creating log file %s\n", err)
+			return fmt.Errorf("error in creating label %s %s\n", c.String("label"), err)
 		}
-		defer l.Close()
-		logger = log.New(l, "gmail-webhook", log.Lshortfile)
+		logrus.Infof("created label %s", label.Name)
+	case err == labels.ErrNotFound:
+		return fmt.Errorf("given label %s does not exist\n", c.String("label"))
+	case err != nil:
+		return fmt.Errorf("error in looking up label %s\n", err)
 	}
-	rgxp, err := regexp.Compile(`Order_Type:(\w+)\|(\w+)`)
+
+	dlStore, err := openDeadLetter(c, hdb)
 	if err != nil {
-		log.Fatalf("error in creating regexp %s\n", err)
+		return fmt.Errorf("error in opening dead-letter store %s\n", err)
+	}
+	if dlStore != nil {
+		defer dlStore.Close()
 	}
+	mb := mailbox.New(gmClient)
+	mb.Parallelism = c.Int("gmail-parallelism")
+	mb.Retries = c.Int("gmail-retries")
 	dsc := &handlers.DscClient{
 		Gmail:       gmClient,
+		Mailbox:     mb,
 		Github:      ghClient,
-		Label:       lm.Name2Id(c.String("label")),
+		Label:       label.Id,
+		Labels:      lm,
 		Repository:  c.String("repository"),
 		Owner:       c.String("owner"),
 		HistoryDbh:  hdb,
-		Logger:      logger,
-		TypeMatcher: rgxp,
-	}
-	dscChain := apollo.New(
-		apollo.Wrap(logMw.LoggerMiddleware),
-		middlewares.DecodeMiddleware,
-		valMw.ValidateMiddleware,
-	).With(context.Background()).ThenFunc(dsc.StockOrderHandler)
-
-	mux.Handle("/gmail/order", dscChain)
-	log.Printf("Starting web server on port %d\n", c.Int("port"))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", c.Int("port")), mux))
+		TypeMatcher: orderTypeMatcher,
+		MaxAge:      c.Duration("max-age"),
+		Stats:       handlers.NewStats(),
+		DeadLetter:  dlStore,
+		DryRun:      c.Bool("dry-run"),
+		Triggers:    triggers(c),
+		OrderPrefix: c.String("order-prefix"),
+	}
+	if dsc.DryRun {
+		logrus.Warn("dry run, issues are only printed and the history cursor is not moved")
+	}
+	if c.Bool("reply") && !dsc.DryRun {
+		tmpl, err := reply.ParseTemplate(c.String("reply-template"))
+		if err != nil {
+			return err
+		}
+		dsc.Replier = &reply.Replier{
+			Template: tmpl,
+			IssueURL: c.Bool("reply-issue-url"),
+			Limit:    c.Int("reply-limit"),
+			Window:   c.Duration("reply-window"),
+			Counter:  hdb,
+		}
+	}
+
+	mux := newMux(
+		dsc,
+		fmt.Sprintf("projects/%s/subscriptions/%s", c.String("project"), c.String("subscription")),
+		c.String("mode") == "push",
+	)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	return serve(c, mux, dsc, sig)
+}
+
+// newMux routes the probes and the metrics, and in push mode the
+// notifications of the subscription through the stock order pipeline
+func newMux(dsc *handlers.DscClient, subscription string, push bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", dsc.HealthHandler)
+	mux.HandleFunc("/readyz", dsc.ReadyHandler)
+	mux.HandleFunc("/status", dsc.StatusHandler)
+	mux.Handle("/metrics", metrics.Handler())
+	if push {
+		logMw := middlewares.NewMiddlewareFromLogger(logrus.StandardLogger(), "web")
+		valMw := &middlewares.GmailSubscription{Name: subscription}
+		dscChain := middlewares.Chain(
+			http.HandlerFunc(dsc.StockOrderHandler),
+			middlewares.TracingMiddleware("/gmail/order"),
+			middlewares.MetricsMiddleware("/gmail/order"),
+			logMw.LoggerMiddleware,
+			middlewares.DecodeMiddleware,
+			valMw.ValidateMiddleware,
+		)
+		mux.Handle("/gmail/order", dscChain)
+	}
+	return mux
+}
+
+// serve runs the web server, and the subscriber in pull mode, until a
+// signal is received. It then stops accepting new requests and pulling
+// messages, and waits for the in-flight ones to finish within the
+// shutdown timeout.
+func serve(c *cli.Context, h http.Handler, dsc *handlers.DscClient, sig <-chan os.Signal) error {
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", c.Int("port")),
+		Handler:      h,
+		ReadTimeout:  c.Duration("read-timeout"),
+		WriteTimeout: c.Duration("write-timeout"),
+		IdleTimeout:  c.Duration("idle-timeout"),
+	}
+	errc := make(chan error, 1)
+	go func() {
+		logrus.Infof("Starting web server on port %d", c.Int("port"))
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			errc <- err
+		}
+	}()
+
+	stop, cancelStop := context.WithCancel(context.Background())
+	defer cancelStop()
+	work, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	// stays nil in push mode, receiving from it blocks forever
+	var pulled chan error
+	if c.String("mode") == "pull" {
+		pulled = make(chan error, 1)
+		go func() {
+			pulled <- runPuller(stop, work, c, dsc)
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case err := <-pulled:
+		srv.Close()
+		return err
+	case s := <-sig:
+		logrus.Infof("received %s, shutting down", s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("shutdown-timeout"))
+	defer cancel()
+	cancelStop()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return fmt.Errorf("error in draining in-flight requests %s\n", err)
+	}
+	logrus.Info("web server stopped")
+	if pulled == nil {
+		return nil
+	}
+	select {
+	case err := <-pulled:
+		logrus.Info("subscriber stopped")
+		return err
+	case <-ctx.Done():
+		cancelWork()
+		return fmt.Errorf("error in draining subscriber: message still in progress after %s\n", c.Duration("shutdown-timeout"))
+	}
 }
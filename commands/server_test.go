@@ -0,0 +1,604 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dictybase/gmail-webhook/deadletter"
+	"github.com/dictybase/gmail-webhook/handlers"
+	"github.com/dictybase/gmail-webhook/history"
+	"github.com/dictybase/gmail-webhook/mailbox"
+	"github.com/dictybase/gmail-webhook/testing/fake"
+	"github.com/google/go-github/github"
+	"google.golang.org/api/gmail/v1"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const (
+	testSubscription = "projects/dictybase/subscriptions/gmail-order"
+	testLabel        = "Label_1"
+)
+
+// pipeline is the push server of run wired to the fake gmail and github
+type pipeline struct {
+	gmail  *fake.Gmail
+	github *fake.Github
+	hdb    *history.HistoryDb
+	dl     deadletter.Store
+	dsc    *handlers.DscClient
+	server *httptest.Server
+}
+
+func newPipeline(t *testing.T) *pipeline {
+	p := &pipeline{gmail: fake.NewGmail(), github: fake.NewGithub()}
+	t.Cleanup(p.gmail.Close)
+	t.Cleanup(p.github.Close)
+	p.gmail.AddLabel(testLabel, "Orders/Stock center")
+
+	gm, err := gmail.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gm.BasePath = p.gmail.BasePath()
+	gh := github.NewClient(nil)
+	gh.BaseURL, err = url.Parse(p.github.BaseURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rd := miniredis.RunT(t)
+	p.hdb, err = history.NewHistoryDb(rd.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.hdb.Close() })
+	if err := p.hdb.AddStartHistory(p.gmail.HistoryID()); err != nil {
+		t.Fatal(err)
+	}
+	p.dl = deadletter.NewRedisStore(p.hdb)
+
+	// fail right away instead of backing off in the tests
+	mb := mailbox.New(gm)
+	mb.Retries = 0
+	p.dsc = &handlers.DscClient{
+		Gmail:       gm,
+		Mailbox:     mb,
+		Github:      gh,
+		Label:       testLabel,
+		Repository:  "orders",
+		Owner:       "dictybase",
+		HistoryDbh:  p.hdb,
+		TypeMatcher: orderTypeMatcher,
+		Stats:       handlers.NewStats(),
+		DeadLetter:  p.dl,
+		OrderPrefix: "DSC",
+	}
+	p.server = httptest.NewServer(newMux(p.dsc, testSubscription, true))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// addOrder delivers an order email to the mailbox and returns
+// the history id gmail would notify about
+func (p *pipeline) addOrder(id, subject, body string, labelIds ...string) uint64 {
+	return p.gmail.AddMessage(&gmail.Message{
+		Id:       id,
+		ThreadId: id,
+		LabelIds: labelIds,
+		Payload: &gmail.MessagePart{
+			MimeType: "text/plain",
+			Headers:  []*gmail.MessagePartHeader{{Name: "Subject", Value: subject}},
+			Body:     &gmail.MessagePartBody{Data: body},
+		},
+	})
+}
+
+func (p *pipeline) push(t *testing.T, subscription string, historyId uint64) int {
+	body := fake.PushEnvelope(subscription, "orders@dictybase.org", historyId)
+	res, err := http.Post(p.server.URL+"/gmail/order", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+// pushPublished delivers a notification that was published at the given time
+func (p *pipeline) pushPublished(t *testing.T, historyId uint64, published time.Time) int {
+	data := fmt.Sprintf(`{"emailAddress":"orders@dictybase.org","historyId":%d}`, historyId)
+	body := fmt.Sprintf(
+		`{"subscription":%q,"message":{"data":%q,"messageId":"1","publishTime":%q}}`,
+		testSubscription, encode(data), published.Format(time.RFC3339Nano),
+	)
+	res, err := http.Post(p.server.URL+"/gmail/order", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func (p *pipeline) issues() []*github.Issue {
+	return p.github.Issues("dictybase", "orders")
+}
+
+func encode(s string) string {
+	return base64.URLEncoding.EncodeToString([]byte(s))
+}
+
+func TestPushCreatesIssue(t *testing.T) {
+	p := newPipeline(t)
+	histId := p.addOrder("m1", "Stock order", encode("Order_Type:strain|plasmid\nDBS0236123"), testLabel)
+	if code := p.push(t, testSubscription, histId); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	issues := p.issues()
+	if len(issues) != 1 {
+		t.Fatalf("got %d issues, want 1", len(issues))
+	}
+	issue := issues[0]
+	if !strings.HasPrefix(*issue.Title, "[DSC-") || !strings.HasSuffix(*issue.Title, "Stock order") {
+		t.Errorf("got title %q, want the order id and the subject", *issue.Title)
+	}
+	if len(issue.Labels) != 2 {
+		t.Errorf("got labels %v, want the strain and plasmid labels", issue.Labels)
+	}
+	current, err := p.hdb.GetCurrentHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != histId {
+		t.Errorf("got current history %d, want %d", current, histId)
+	}
+
+	// a redelivered notification does not file the order twice
+	if code := p.push(t, testSubscription, histId); code != http.StatusOK {
+		t.Fatalf("got status %d on redelivery, want %d", code, http.StatusOK)
+	}
+	if n := len(p.issues()); n != 1 {
+		t.Errorf("got %d issues after redelivery, want 1", n)
+	}
+
+	// the ledger keeps a backfill or replay from filing the order twice
+	msg, err := p.dsc.Gmail.Users.Messages.Get("me", "m1").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := p.dsc.ProcessMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("got a second issue for a filed message")
+	}
+	if n := len(p.issues()); n != 1 {
+		t.Errorf("got %d issues after processing the message again, want 1", n)
+	}
+}
+
+func TestPushSkipsOtherLabels(t *testing.T) {
+	p := newPipeline(t)
+	histId := p.addOrder("m1", "Newsletter", encode("nothing to order"), "INBOX")
+	if code := p.push(t, testSubscription, histId); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if n := len(p.issues()); n != 0 {
+		t.Errorf("got %d issues, want none", n)
+	}
+}
+
+func TestPushLabelAdded(t *testing.T) {
+	p := newPipeline(t)
+	p.dsc.Triggers = []string{mailbox.MessageAdded, mailbox.LabelAdded}
+	p.addOrder("m1", "Stock order", encode("Order_Type:strain|none"), "INBOX")
+	histId := p.gmail.LabelMessage("m1", testLabel)
+	if code := p.push(t, testSubscription, histId); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	issues := p.issues()
+	if len(issues) != 1 {
+		t.Fatalf("got %d issues for the labeled message, want 1", len(issues))
+	}
+	if !strings.HasSuffix(*issues[0].Title, "Stock order") {
+		t.Errorf("got title %q, want the subject of the labeled message", *issues[0].Title)
+	}
+}
+
+func TestPushRetriesTransientFailure(t *testing.T) {
+	p := newPipeline(t)
+	start := p.gmail.HistoryID()
+	histId := p.addOrder("m1", "Stock order", encode("Order_Type:strain|none"), testLabel)
+	p.gmail.Fail(http.StatusServiceUnavailable)
+	if code := p.push(t, testSubscription, histId); code < 500 {
+		t.Fatalf("got status %d, want a server error for pubsub to redeliver", code)
+	}
+	current, err := p.hdb.GetCurrentHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != start {
+		t.Errorf("got current history %d after a failure, want %d", current, start)
+	}
+	if code := p.push(t, testSubscription, histId); code != http.StatusOK {
+		t.Fatalf("got status %d on redelivery, want %d", code, http.StatusOK)
+	}
+	if n := len(p.issues()); n != 1 {
+		t.Errorf("got %d issues after redelivery, want 1", n)
+	}
+}
+
+func TestPushSkipsExpiredHistory(t *testing.T) {
+	p := newPipeline(t)
+	p.addOrder("m1", "Stock order", encode("Order_Type:strain|none"), testLabel)
+	p.gmail.ExpireHistory()
+	histId := p.addOrder("m2", "Plasmid order", encode("Order_Type:none|plasmid"), testLabel)
+	if code := p.push(t, testSubscription, histId); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	// the orders of the gap are left to a backfill
+	if n := len(p.issues()); n != 0 {
+		t.Errorf("got %d issues, want none", n)
+	}
+	current, err := p.hdb.GetCurrentHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != histId {
+		t.Errorf("got current history %d, want the history of the mailbox %d", current, histId)
+	}
+	histId = p.addOrder("m3", "Stock order", encode("Order_Type:strain|none"), testLabel)
+	if code := p.push(t, testSubscription, histId); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if n := len(p.issues()); n != 1 {
+		t.Errorf("got %d issues after the gap, want 1", n)
+	}
+}
+
+func TestPushTakesOverExpiredClaim(t *testing.T) {
+	p := newPipeline(t)
+	histId := p.addOrder("m1", "Stock order", encode("Order_Type:strain|none"), testLabel)
+	// a delivery claimed the message long ago and was killed before filing it
+	if _, err := p.hdb.Do("HSET", "processed-messages", "m1", "pending:1:1"); err != nil {
+		t.Fatal(err)
+	}
+	if code := p.push(t, testSubscription, histId); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if n := len(p.issues()); n != 1 {
+		t.Errorf("got %d issues, want the order filed once", n)
+	}
+	known, err := p.hdb.IsProcessed("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !known {
+		t.Error("got the message unfiled in the ledger")
+	}
+}
+
+func TestPushDeadLettersPermanentFailure(t *testing.T) {
+	p := newPipeline(t)
+	p.addOrder("m1", "Broken order", "not base64 %%", testLabel)
+	histId := p.addOrder("m2", "Stock order", encode("Order_Type:strain|none"), testLabel)
+	if code := p.push(t, testSubscription, histId); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if n := len(p.issues()); n != 1 {
+		t.Errorf("got %d issues, want 1 for the valid order", n)
+	}
+	e, err := p.dl.Get("m1")
+	if err != nil {
+		t.Fatalf("broken order is not dead-lettered %s", err)
+	}
+
+	// the replay files the order once its body is readable
+	e.Message.Payload.Body.Data = encode("Order_Type:none|plasmid")
+	if _, err := p.dsc.ProcessMessage(context.Background(), e.Message); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.issues()); n != 2 {
+		t.Errorf("got %d issues after the replay, want 2", n)
+	}
+}
+
+func TestPushDryRun(t *testing.T) {
+	p := newPipeline(t)
+	var out bytes.Buffer
+	p.dsc.DryRun = true
+	p.dsc.DryRunOutput = &out
+	start := p.gmail.HistoryID()
+	histId := p.addOrder("m1", "Stock order", encode("Order_Type:strain|none"), testLabel)
+	if code := p.push(t, testSubscription, histId); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if n := len(p.issues()); n != 0 {
+		t.Errorf("got %d issues in a dry run, want none", n)
+	}
+	var preview handlers.Preview
+	if err := json.Unmarshal(out.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if preview.MessageID != "m1" || !strings.HasSuffix(preview.Title, "Stock order") || preview.Repository != "dictybase/orders" {
+		t.Errorf("got preview %+v, want the issue of m1", preview)
+	}
+	// the sequence is left untouched by a dry run
+	if !strings.HasSuffix(preview.OrderID, "-?????") {
+		t.Errorf("got order id %q in a dry run, want a placeholder", preview.OrderID)
+	}
+	current, err := p.hdb.GetCurrentHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != start {
+		t.Errorf("got current history %d after a dry run, want %d", current, start)
+	}
+}
+
+func TestPushRejectsOtherSubscription(t *testing.T) {
+	p := newPipeline(t)
+	histId := p.addOrder("m1", "Stock order", encode("Order_Type:strain|none"), testLabel)
+	code := p.push(t, "projects/dictybase/subscriptions/other", histId)
+	if code != http.StatusAccepted {
+		t.Errorf("got status %d, want %d to acknowledge without processing", code, http.StatusAccepted)
+	}
+	if n := len(p.issues()); n != 0 {
+		t.Errorf("got %d issues, want none", n)
+	}
+}
+
+func TestPushReconcilesStaleNotification(t *testing.T) {
+	cases := []struct {
+		name      string
+		published time.Time
+		current   uint64
+	}{
+		// a live notification moves the history to its own id
+		{"live", time.Now(), 1001},
+		// a stale one is reconciled up to the latest stored history
+		{"stale", time.Now().Add(-time.Hour), 1002},
+	}
+	for _, c := range cases {
+		p := newPipeline(t)
+		p.dsc.MaxAge = time.Minute
+		histId := p.addOrder("m1", "Stock order", encode("Order_Type:strain|none"), testLabel)
+		p.addOrder("m2", "Plasmid order", encode("Order_Type:none|plasmid"), testLabel)
+		if code := p.pushPublished(t, histId, c.published); code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d", c.name, code, http.StatusOK)
+		}
+		if n := len(p.issues()); n != 2 {
+			t.Errorf("%s: got %d issues, want 2", c.name, n)
+		}
+		current, err := p.hdb.GetCurrentHistory()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current != c.current {
+			t.Errorf("%s: got current history %d, want %d", c.name, current, c.current)
+		}
+	}
+}
+
+// pullContext is the context of the run command in pull mode, subscribed
+// to a topic of the emulator
+func pullContext(t *testing.T) (*cli.Context, *pubsub.Topic) {
+	c, _ := serverContext(t, "pull")
+	client := newEmulator(t)
+	ctx := context.Background()
+	topic, err := client.CreateTopic(ctx, "gmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(topic.Stop)
+	_, err = client.CreateSubscription(ctx, "gmail-order", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, topic
+}
+
+func publish(t *testing.T, topic *pubsub.Topic, historyId uint64) {
+	data := fmt.Sprintf(`{"emailAddress":"orders@dictybase.org","historyId":%d}`, historyId)
+	ctx := context.Background()
+	if _, err := topic.Publish(ctx, &pubsub.Message{Data: []byte(data)}).Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForCursor polls the current history until it reaches want
+func waitForCursor(t *testing.T, hdb *history.HistoryDb, want uint64) uint64 {
+	var current uint64
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		var err error
+		current, err = hdb.GetCurrentHistory()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current == want {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return current
+}
+
+func TestPullReconcilesStaleNotification(t *testing.T) {
+	cases := []struct {
+		name    string
+		maxAge  time.Duration
+		current uint64
+	}{
+		{"live", time.Hour, 1001},
+		// the emulator publishes at the current time,
+		// so any message is older than a nanosecond
+		{"stale", time.Nanosecond, 1002},
+	}
+	for _, c := range cases {
+		p := newPipeline(t)
+		p.dsc.MaxAge = c.maxAge
+		histId := p.addOrder("m1", "Stock order", encode("Order_Type:strain|none"), testLabel)
+		p.addOrder("m2", "Plasmid order", encode("Order_Type:none|plasmid"), testLabel)
+		ctx, topic := pullContext(t)
+		publish(t, topic, histId)
+		stop, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- runPuller(stop, context.Background(), ctx, p.dsc) }()
+		current := waitForCursor(t, p.hdb, c.current)
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if current != c.current {
+			t.Errorf("%s: got current history %d, want %d", c.name, current, c.current)
+		}
+		if n := len(p.issues()); n != 2 {
+			t.Errorf("%s: got %d issues, want 2", c.name, n)
+		}
+	}
+}
+
+// serverContext is the context of the run command listening on a free
+// port, in pull mode it subscribes to gmail-order
+func serverContext(t *testing.T, mode string) (*cli.Context, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	set := flag.NewFlagSet("run", flag.ContinueOnError)
+	set.Int("port", port, "")
+	set.String("mode", mode, "")
+	set.String("project", "dictybase", "")
+	set.String("subscription", "gmail-order", "")
+	set.Duration("max-extension", time.Minute, "")
+	set.Duration("read-timeout", time.Minute, "")
+	set.Duration("write-timeout", time.Minute, "")
+	set.Duration("idle-timeout", time.Minute, "")
+	set.Duration("shutdown-timeout", 5*time.Second, "")
+	return cli.NewContext(cli.NewApp(), set, nil), fmt.Sprintf("http://127.0.0.1:%d", port)
+}
+
+func TestShutdownDrainsInFlightRequest(t *testing.T) {
+	c, addr := serverContext(t, "push")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("done"))
+	})
+	sig := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- serve(c, h, nil, sig) }()
+	for i := 0; ; i++ {
+		res, err := http.Get(addr + "/ping")
+		if err == nil {
+			res.Body.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("server did not start %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	responded := make(chan int, 1)
+	go func() {
+		res, err := http.Get(addr + "/slow")
+		if err != nil {
+			t.Error(err)
+			responded <- 0
+			return
+		}
+		res.Body.Close()
+		responded <- res.StatusCode
+	}()
+	<-started
+	sig <- syscall.SIGTERM
+	select {
+	case err := <-served:
+		t.Fatalf("shutdown returned with a request in flight %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if code := <-responded; code != http.StatusOK {
+		t.Errorf("got status %d for the in-flight request, want %d", code, http.StatusOK)
+	}
+}
+
+// blockingTransport holds the first request until release is closed
+type blockingTransport struct {
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	b.once.Do(func() {
+		close(b.started)
+		<-b.release
+	})
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestShutdownDrainsPulledMessage(t *testing.T) {
+	p := newPipeline(t)
+	bt := &blockingTransport{started: make(chan struct{}), release: make(chan struct{})}
+	gh := github.NewClient(&http.Client{Transport: bt})
+	gh.BaseURL = p.dsc.Github.BaseURL
+	p.dsc.Github = gh
+	histId := p.addOrder("m1", "Stock order", encode("Order_Type:strain|none"), testLabel)
+	c, topic := pullContext(t)
+	publish(t, topic, histId)
+
+	sig := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- serve(c, http.NotFoundHandler(), p.dsc, sig) }()
+	select {
+	case <-bt.started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the message was not pulled")
+	}
+	sig <- syscall.SIGTERM
+	select {
+	case err := <-served:
+		t.Fatalf("shutdown returned with a message in flight %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(bt.release)
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.issues()); n != 1 {
+		t.Errorf("got %d issues for the in-flight message, want 1", n)
+	}
+	current, err := p.hdb.GetCurrentHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != histId {
+		t.Errorf("got current history %d, want %d", current, histId)
+	}
+}
@@ -0,0 +1,343 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/pubsub"
+	"github.com/dictybase/gmail-webhook/auth"
+	"github.com/dictybase/gmail-webhook/history"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// gmailPushMember is the account gmail publishes the notifications with
+const gmailPushMember = "serviceAccount:gmail-api-push@system.gserviceaccount.com"
+
+// setupStep is a single idempotent step of the setup
+type setupStep struct {
+	name string
+	// plan returns the change the step would make, it is
+	// empty when the resource is already set up
+	plan  func(ctx context.Context) (string, error)
+	apply func(ctx context.Context) error
+}
+
+func ValidateSetupOptions(c *cli.Context) error {
+	for _, v := range []string{"project", "topic", "subscription", "endpoint"} {
+		if !c.IsSet(v) {
+			return fmt.Errorf("missing command line argument %s\n", v)
+		}
+	}
+	if c.IsSet("oidc-audience") && !c.IsSet("oidc-service-account") {
+		return fmt.Errorf("oidc-audience needs the oidc-service-account argument\n")
+	}
+	return nil
+}
+
+// SetupAction brings the pubsub topic, its iam policy, the push subscription
+// and the gmail watch to the declared state. It only prints the plan,
+// the changes are made with --apply.
+func SetupAction(c *cli.Context) {
+	if err := ValidateSetupOptions(c); err != nil {
+		logrus.Fatal(err)
+	}
+	ctx := context.Background()
+	client, err := auth.GetPubsubClient(ctx, c, c.String("project"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer client.Close()
+	hdb, err := history.NewHistoryDb(redisAddress(c))
+	if err != nil {
+		logrus.Fatalf("error in connecting to history db %s", err)
+	}
+	defer hdb.Close()
+
+	steps := setupSteps(c, client, hdb)
+	var pending []setupStep
+	for _, s := range steps {
+		change, err := s.plan(ctx)
+		if err != nil {
+			logrus.Fatalf("error in planning %s %s", s.name, err)
+		}
+		if change == "" {
+			logrus.Infof("%s: up to date", s.name)
+			continue
+		}
+		logrus.Infof("%s: %s", s.name, change)
+		pending = append(pending, s)
+	}
+	if len(pending) == 0 {
+		logrus.Info("nothing to do")
+		return
+	}
+	if !c.Bool("apply") {
+		logrus.Infof("%d changes planned, run again with --apply to make them", len(pending))
+		return
+	}
+	for _, s := range pending {
+		if err := s.apply(ctx); err != nil {
+			logrus.Fatalf("error in applying %s %s", s.name, err)
+		}
+		logrus.Infof("%s: done", s.name)
+	}
+}
+
+func setupSteps(c *cli.Context, client *pubsub.Client, hdb *history.HistoryDb) []setupStep {
+	project := c.String("project")
+	topic := client.Topic(c.String("topic"))
+	var topicExists, dlExists, subExists bool
+	steps := []setupStep{topicStep(client, topic, &topicExists)}
+	emulator := os.Getenv("PUBSUB_EMULATOR_HOST") != ""
+	if emulator {
+		logrus.Info("skipping the iam policies, they are not supported by the emulator")
+	} else {
+		steps = append(steps, grantStep(
+			"topic iam", topic.IAM, &topicExists,
+			gmailPushMember, "roles/pubsub.publisher",
+		))
+	}
+
+	var deadLetter *pubsub.DeadLetterPolicy
+	var subGrant *setupStep
+	if c.IsSet("dead-letter-topic") {
+		dlTopic := client.Topic(c.String("dead-letter-topic"))
+		deadLetter = &pubsub.DeadLetterPolicy{
+			DeadLetterTopic:     dlTopic.String(),
+			MaxDeliveryAttempts: c.Int("max-delivery-attempts"),
+		}
+		steps = append(steps, topicStep(client, dlTopic, &dlExists))
+		// pubsub forwards the dead letters with its own service agent
+		if c.IsSet("project-number") && !emulator {
+			agent := fmt.Sprintf(
+				"serviceAccount:service-%s@gcp-sa-pubsub.iam.gserviceaccount.com",
+				c.String("project-number"),
+			)
+			steps = append(
+				steps,
+				grantStep("dead-letter topic iam", dlTopic.IAM, &dlExists, agent, "roles/pubsub.publisher"),
+			)
+			// has to wait for the subscription
+			g := grantStep(
+				"subscription iam", client.Subscription(c.String("subscription")).IAM,
+				&subExists, agent, "roles/pubsub.subscriber",
+			)
+			subGrant = &g
+		}
+	}
+
+	want := pubsub.SubscriptionConfig{
+		Topic:            topic,
+		AckDeadline:      c.Duration("ack-deadline"),
+		DeadLetterPolicy: deadLetter,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinimumBackoff: c.Duration("min-backoff"),
+			MaximumBackoff: c.Duration("max-backoff"),
+		},
+		PushConfig: pubsub.PushConfig{Endpoint: c.String("endpoint")},
+	}
+	if c.IsSet("oidc-service-account") {
+		want.PushConfig.AuthenticationMethod = &pubsub.OIDCToken{
+			ServiceAccountEmail: c.String("oidc-service-account"),
+			Audience:            c.String("oidc-audience"),
+		}
+	}
+	steps = append(steps, subscriptionStep(client, client.Subscription(c.String("subscription")), want, &subExists))
+	if subGrant != nil {
+		steps = append(steps, *subGrant)
+	}
+
+	if !c.Bool("skip-watch") {
+		steps = append(steps, watchStep(
+			c, hdb,
+			fmt.Sprintf("projects/%s/topics/%s", project, c.String("topic")),
+		))
+	}
+	return steps
+}
+
+func topicStep(client *pubsub.Client, topic *pubsub.Topic, exists *bool) setupStep {
+	return setupStep{
+		name: "topic " + topic.ID(),
+		plan: func(ctx context.Context) (string, error) {
+			ok, err := topic.Exists(ctx)
+			if err != nil {
+				return "", err
+			}
+			*exists = ok
+			if ok {
+				return "", nil
+			}
+			return "create " + topic.String(), nil
+		},
+		apply: func(ctx context.Context) error {
+			_, err := client.CreateTopic(ctx, topic.ID())
+			return err
+		},
+	}
+}
+
+// grantStep gives the member the role on a resource, exists tells
+// whether the resource is there to read the current policy from
+func grantStep(name string, handle func() *iam.Handle, exists *bool, member string, role iam.RoleName) setupStep {
+	change := fmt.Sprintf("grant %s to %s", role, member)
+	return setupStep{
+		name: name,
+		plan: func(ctx context.Context) (string, error) {
+			if !*exists {
+				return change, nil
+			}
+			policy, err := handle().Policy(ctx)
+			if err != nil {
+				return "", err
+			}
+			if policy.HasRole(member, role) {
+				return "", nil
+			}
+			return change, nil
+		},
+		apply: func(ctx context.Context) error {
+			policy, err := handle().Policy(ctx)
+			if err != nil {
+				return err
+			}
+			policy.Add(member, role)
+			return handle().SetPolicy(ctx, policy)
+		},
+	}
+}
+
+func subscriptionStep(client *pubsub.Client, sub *pubsub.Subscription, want pubsub.SubscriptionConfig, exists *bool) setupStep {
+	return setupStep{
+		name: "subscription " + sub.ID(),
+		plan: func(ctx context.Context) (string, error) {
+			ok, err := sub.Exists(ctx)
+			if err != nil {
+				return "", err
+			}
+			*exists = ok
+			if !ok {
+				return fmt.Sprintf("create push subscription to %s", want.PushConfig.Endpoint), nil
+			}
+			cur, err := sub.Config(ctx)
+			if err != nil {
+				return "", err
+			}
+			if cur.Topic.String() != want.Topic.String() {
+				return "", fmt.Errorf(
+					"subscription is attached to %s instead of %s, it has to be deleted first",
+					cur.Topic, want.Topic,
+				)
+			}
+			return strings.Join(subscriptionChanges(cur, want), ", "), nil
+		},
+		apply: func(ctx context.Context) error {
+			if !*exists {
+				_, err := client.CreateSubscription(ctx, sub.ID(), want)
+				return err
+			}
+			// a nil policy leaves the current one in place,
+			// the zero value removes it
+			deadLetter := want.DeadLetterPolicy
+			if deadLetter == nil {
+				deadLetter = &pubsub.DeadLetterPolicy{}
+			}
+			_, err := sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{
+				PushConfig:       &want.PushConfig,
+				AckDeadline:      want.AckDeadline,
+				DeadLetterPolicy: deadLetter,
+				RetryPolicy:      want.RetryPolicy,
+			})
+			return err
+		},
+	}
+}
+
+// subscriptionChanges describes the differences between
+// the current and the wanted subscription settings
+func subscriptionChanges(cur, want pubsub.SubscriptionConfig) []string {
+	var changes []string
+	if cur.PushConfig.Endpoint != want.PushConfig.Endpoint {
+		changes = append(changes, fmt.Sprintf("update endpoint %q to %q", cur.PushConfig.Endpoint, want.PushConfig.Endpoint))
+	}
+	if cur.AckDeadline != want.AckDeadline {
+		changes = append(changes, fmt.Sprintf("update ack deadline %s to %s", cur.AckDeadline, want.AckDeadline))
+	}
+	if describeOIDC(cur.PushConfig) != describeOIDC(want.PushConfig) {
+		changes = append(changes, fmt.Sprintf("update push auth %s to %s", describeOIDC(cur.PushConfig), describeOIDC(want.PushConfig)))
+	}
+	if describeDeadLetter(cur.DeadLetterPolicy) != describeDeadLetter(want.DeadLetterPolicy) {
+		changes = append(changes, fmt.Sprintf(
+			"update dead letter policy %s to %s",
+			describeDeadLetter(cur.DeadLetterPolicy), describeDeadLetter(want.DeadLetterPolicy),
+		))
+	}
+	if describeRetry(cur.RetryPolicy) != describeRetry(want.RetryPolicy) {
+		changes = append(changes, fmt.Sprintf(
+			"update retry policy %s to %s",
+			describeRetry(cur.RetryPolicy), describeRetry(want.RetryPolicy),
+		))
+	}
+	return changes
+}
+
+func describeOIDC(pc pubsub.PushConfig) string {
+	token, ok := pc.AuthenticationMethod.(*pubsub.OIDCToken)
+	if !ok || token == nil {
+		return "none"
+	}
+	return fmt.Sprintf("oidc(%s, audience %q)", token.ServiceAccountEmail, token.Audience)
+}
+
+func describeDeadLetter(p *pubsub.DeadLetterPolicy) string {
+	if p == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s after %d attempts", p.DeadLetterTopic, p.MaxDeliveryAttempts)
+}
+
+func describeRetry(p *pubsub.RetryPolicy) string {
+	if p == nil {
+		return "none"
+	}
+	min, _ := p.MinimumBackoff.(time.Duration)
+	max, _ := p.MaximumBackoff.(time.Duration)
+	return fmt.Sprintf("backoff %s-%s", min, max)
+}
+
+// watchStep starts the gmail watch unless the stored one is still
+// valid for longer than the renew-before duration
+func watchStep(c *cli.Context, hdb *history.HistoryDb, topic string) setupStep {
+	return setupStep{
+		name: "gmail watch",
+		plan: func(ctx context.Context) (string, error) {
+			ok, err := hdb.HasWatchExpiration()
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				exp, err := hdb.GetWatchExpiration()
+				if err != nil {
+					return "", err
+				}
+				if time.Until(exp) > c.Duration("renew-before") {
+					return "", nil
+				}
+			}
+			return "watch the mailbox with " + topic, nil
+		},
+		apply: func(ctx context.Context) error {
+			gm, err := auth.GetGmailClient(c)
+			if err != nil {
+				return err
+			}
+			return watchGmail(gm, hdb, &gmail.WatchRequest{TopicName: topic})
+		},
+	}
+}
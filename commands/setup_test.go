@@ -0,0 +1,120 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// newEmulator starts an in-process pubsub emulator
+// and returns a client connected to it
+func newEmulator(t *testing.T) *pubsub.Client {
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pubsub.NewClient(context.Background(), "dictybase", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newSetupContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("setup", flag.ContinueOnError)
+	for _, name := range []string{
+		"project", "project-number", "topic", "subscription", "endpoint",
+		"dead-letter-topic", "oidc-service-account", "oidc-audience",
+	} {
+		set.String(name, "", "")
+	}
+	set.Duration("ack-deadline", 10*time.Second, "")
+	set.Int("max-delivery-attempts", 5, "")
+	set.Duration("min-backoff", 10*time.Second, "")
+	set.Duration("max-backoff", 10*time.Minute, "")
+	set.Bool("skip-watch", false, "")
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+// converge applies the planned changes of the steps and
+// checks that planning again finds nothing left to do
+func converge(t *testing.T, steps []setupStep) []string {
+	ctx := context.Background()
+	var changes []string
+	for _, s := range steps {
+		change, err := s.plan(ctx)
+		if err != nil {
+			t.Fatalf("error in planning %s %s", s.name, err)
+		}
+		if change == "" {
+			continue
+		}
+		changes = append(changes, s.name+": "+change)
+		if err := s.apply(ctx); err != nil {
+			t.Fatalf("error in applying %s %s", s.name, err)
+		}
+	}
+	for _, s := range steps {
+		change, err := s.plan(ctx)
+		if err != nil {
+			t.Fatalf("error in planning %s %s", s.name, err)
+		}
+		if change != "" {
+			t.Errorf("%s is not up to date after apply: %s", s.name, change)
+		}
+	}
+	return changes
+}
+
+func TestSetupSteps(t *testing.T) {
+	client := newEmulator(t)
+	args := []string{
+		"--project", "dictybase", "--topic", "gmail", "--subscription", "gmail-order",
+		"--endpoint", "https://orders.dictybase.org/gmail/order", "--skip-watch",
+	}
+	withDeadLetter := append([]string{"--dead-letter-topic", "gmail-dead", "--ack-deadline", "30s"}, args...)
+
+	cases := []struct {
+		name    string
+		args    []string
+		changes int
+		dlq     string
+	}{
+		{"create", withDeadLetter, 3, "projects/dictybase/topics/gmail-dead"},
+		{"unchanged", withDeadLetter, 0, "projects/dictybase/topics/gmail-dead"},
+		{"remove dead letter", args, 1, ""},
+		{"unchanged without dead letter", args, 0, ""},
+	}
+	for _, tc := range cases {
+		changes := converge(t, setupSteps(newSetupContext(t, tc.args...), client, nil))
+		if len(changes) != tc.changes {
+			t.Errorf("%s: got changes %q, want %d", tc.name, changes, tc.changes)
+		}
+		cfg, err := client.Subscription("gmail-order").Config(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dlq string
+		if cfg.DeadLetterPolicy != nil {
+			dlq = cfg.DeadLetterPolicy.DeadLetterTopic
+		}
+		if dlq != tc.dlq {
+			t.Errorf("%s: got dead letter topic %q, want %q", tc.name, dlq, tc.dlq)
+		}
+	}
+}
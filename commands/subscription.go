@@ -0,0 +1,177 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/dictybase/gmail-webhook/auth"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// subscriptionDescription is the printed state of a subscription
+type subscriptionDescription struct {
+	Name                string `json:"name"`
+	Topic               string `json:"topic"`
+	Endpoint            string `json:"endpoint,omitempty"`
+	PushAuth            string `json:"push_auth"`
+	AckDeadline         string `json:"ack_deadline"`
+	RetainAckedMessages bool   `json:"retain_acked_messages"`
+	RetentionDuration   string `json:"retention_duration"`
+	DeadLetter          string `json:"dead_letter"`
+	Retry               string `json:"retry"`
+}
+
+// mustPubsubClient authorizes with the credentials and
+// project given to the subscription command
+func mustPubsubClient(c *cli.Context) *pubsub.Client {
+	project := c.GlobalString("project")
+	if project == "" {
+		logrus.Fatal("missing command line argument project")
+	}
+	client, err := auth.GetPubsubClient(context.Background(), c, project)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return client
+}
+
+func subscriptionArg(c *cli.Context, client *pubsub.Client) *pubsub.Subscription {
+	if !c.Args().Present() {
+		logrus.Fatal("missing argument subscription name")
+	}
+	sub := client.Subscription(c.Args().First())
+	ok, err := sub.Exists(context.Background())
+	if err != nil {
+		logrus.Fatalf("error in looking up subscription %s", err)
+	}
+	if !ok {
+		logrus.Fatalf("subscription %s does not exist", c.Args().First())
+	}
+	return sub
+}
+
+func ListSubscriptionsAction(c *cli.Context) {
+	client := mustPubsubClient(c)
+	defer client.Close()
+	ctx := context.Background()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTOPIC\tENDPOINT\tACK DEADLINE")
+	it := client.Subscriptions(ctx)
+	for {
+		sub, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			logrus.Fatalf("error in listing subscriptions %s", err)
+		}
+		cfg, err := sub.Config(ctx)
+		if err != nil {
+			logrus.Fatalf("error in retrieving subscription %s %s", sub.ID(), err)
+		}
+		endpoint := cfg.PushConfig.Endpoint
+		if endpoint == "" {
+			endpoint = "(pull)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", sub.ID(), cfg.Topic.ID(), endpoint, cfg.AckDeadline)
+	}
+	w.Flush()
+}
+
+func DescribeSubscriptionAction(c *cli.Context) {
+	client := mustPubsubClient(c)
+	defer client.Close()
+	sub := subscriptionArg(c, client)
+	cfg, err := sub.Config(context.Background())
+	if err != nil {
+		logrus.Fatalf("error in retrieving subscription %s", err)
+	}
+	d := subscriptionDescription{
+		Name:                sub.String(),
+		Topic:               cfg.Topic.String(),
+		Endpoint:            cfg.PushConfig.Endpoint,
+		PushAuth:            describeOIDC(cfg.PushConfig),
+		AckDeadline:         cfg.AckDeadline.String(),
+		RetainAckedMessages: cfg.RetainAckedMessages,
+		RetentionDuration:   cfg.RetentionDuration.String(),
+		DeadLetter:          describeDeadLetter(cfg.DeadLetterPolicy),
+		Retry:               describeRetry(cfg.RetryPolicy),
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(d)
+}
+
+// UpdateEndpointAction moves the push subscription to a new webhook
+// url, the authentication of the push requests is kept
+func UpdateEndpointAction(c *cli.Context) {
+	if c.NArg() != 2 {
+		logrus.Fatal("need the subscription name and the new endpoint as arguments")
+	}
+	client := mustPubsubClient(c)
+	defer client.Close()
+	sub := subscriptionArg(c, client)
+	ctx := context.Background()
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		logrus.Fatalf("error in retrieving subscription %s", err)
+	}
+	old := cfg.PushConfig.Endpoint
+	pc := cfg.PushConfig
+	pc.Endpoint = c.Args().Get(1)
+	if _, err := sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{PushConfig: &pc}); err != nil {
+		logrus.Fatalf("error in updating endpoint %s", err)
+	}
+	logrus.Infof("moved subscription %s from %q to %q", sub.ID(), old, pc.Endpoint)
+}
+
+func DeleteSubscriptionAction(c *cli.Context) {
+	client := mustPubsubClient(c)
+	defer client.Close()
+	sub := subscriptionArg(c, client)
+	if err := sub.Delete(context.Background()); err != nil {
+		logrus.Fatalf("error in deleting subscription %s", err)
+	}
+	logrus.Infof("deleted subscription %s", sub.ID())
+}
+
+// SeekSubscriptionAction marks the messages published after the given time
+// as unacknowledged, so that they are delivered again. Acknowledged
+// messages are only replayed if the subscription retains them.
+func SeekSubscriptionAction(c *cli.Context) {
+	var at time.Time
+	switch {
+	case c.IsSet("time"):
+		t, err := time.Parse(time.RFC3339, c.String("time"))
+		if err != nil {
+			logrus.Fatalf("error in parsing time %s", err)
+		}
+		at = t
+	case c.IsSet("ago"):
+		at = time.Now().Add(-c.Duration("ago"))
+	default:
+		logrus.Fatal("need either the time or the ago argument")
+	}
+	client := mustPubsubClient(c)
+	defer client.Close()
+	sub := subscriptionArg(c, client)
+	ctx := context.Background()
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		logrus.Fatalf("error in retrieving subscription %s", err)
+	}
+	if !cfg.RetainAckedMessages {
+		logrus.Warnf("subscription %s does not retain acknowledged messages, only unacknowledged ones are replayed", sub.ID())
+	}
+	if err := sub.SeekToTime(ctx, at); err != nil {
+		logrus.Fatalf("error in seeking subscription %s", err)
+	}
+	logrus.Infof("subscription %s replays the messages published since %s", sub.ID(), at.Format(time.RFC3339))
+}
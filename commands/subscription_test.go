@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func newSubscriptionContext(t *testing.T, args ...string) *cli.Context {
+	global := flag.NewFlagSet("subscription", flag.ContinueOnError)
+	global.String("project", "dictybase", "")
+	set := flag.NewFlagSet("command", flag.ContinueOnError)
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, cli.NewContext(nil, global, nil))
+}
+
+func TestSubscriptionActions(t *testing.T) {
+	client := newEmulator(t)
+	ctx := context.Background()
+	topic, err := client.CreateTopic(ctx, "gmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.CreateSubscription(ctx, "gmail-order", pubsub.SubscriptionConfig{
+		Topic:      topic,
+		PushConfig: pubsub.PushConfig{Endpoint: "https://orders.dictybase.org/gmail/order"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	UpdateEndpointAction(newSubscriptionContext(t, "gmail-order", "https://webhook.dictybase.org/gmail/order"))
+	cfg, err := client.Subscription("gmail-order").Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PushConfig.Endpoint != "https://webhook.dictybase.org/gmail/order" {
+		t.Errorf("got endpoint %q after update", cfg.PushConfig.Endpoint)
+	}
+
+	DeleteSubscriptionAction(newSubscriptionContext(t, "gmail-order"))
+	ok, err := client.Subscription("gmail-order").Exists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("subscription exists after delete")
+	}
+}
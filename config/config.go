@@ -0,0 +1,386 @@
+// Package config reads the settings of the pipeline from a yaml or toml
+// file. Every setting corresponds to a command line flag, the file only
+// fills in the flags that are neither given on the command line nor by
+// their GMAIL_WEBHOOK_ environment variable.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dictybase/gmail-webhook/filters"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding
+// the settings, the rest is the flag name in upper snake case
+const EnvPrefix = "GMAIL_WEBHOOK_"
+
+// Config declares the pipeline
+type Config struct {
+	// Label is the gmail label of the order emails
+	Label string `yaml:"label" toml:"label"`
+	// Filters apply the label to the order emails
+	Filters    []filters.Filter `yaml:"filters" toml:"filters"`
+	Gmail      Gmail            `yaml:"gmail" toml:"gmail"`
+	Github     Github           `yaml:"github" toml:"github"`
+	Pubsub     Pubsub           `yaml:"pubsub" toml:"pubsub"`
+	Redis      Redis            `yaml:"redis" toml:"redis"`
+	Server     Server           `yaml:"server" toml:"server"`
+	DeadLetter DeadLetter       `yaml:"deadletter" toml:"deadletter"`
+	Reply      Reply            `yaml:"reply" toml:"reply"`
+	Order      Order            `yaml:"order" toml:"order"`
+	Tracing    Tracing          `yaml:"tracing" toml:"tracing"`
+	Log        Log              `yaml:"log" toml:"log"`
+}
+
+type Gmail struct {
+	Secret    string `yaml:"secret" toml:"secret"`
+	CacheFile string `yaml:"cache_file" toml:"cache_file"`
+	// User is impersonated by the service account without a secret
+	User string `yaml:"user" toml:"user"`
+}
+
+type Github struct {
+	// Token is the file with the personal access token
+	Token      string `yaml:"token" toml:"token"`
+	Owner      string `yaml:"owner" toml:"owner"`
+	Repository string `yaml:"repository" toml:"repository"`
+}
+
+type Pubsub struct {
+	Project       string `yaml:"project" toml:"project"`
+	ProjectNumber string `yaml:"project_number" toml:"project_number"`
+	Topic         string `yaml:"topic" toml:"topic"`
+	Subscription  string `yaml:"subscription" toml:"subscription"`
+	Endpoint      string `yaml:"endpoint" toml:"endpoint"`
+	// KeyFile authorizes gmail as well when there is no gmail secret
+	KeyFile         string `yaml:"key_file" toml:"key_file"`
+	DeadLetterTopic string `yaml:"dead_letter_topic" toml:"dead_letter_topic"`
+}
+
+type Redis struct {
+	Address string `yaml:"address" toml:"address"`
+	Port    int    `yaml:"port" toml:"port"`
+}
+
+type Server struct {
+	Port            int    `yaml:"port" toml:"port"`
+	Mode            string `yaml:"mode" toml:"mode"`
+	Trigger         string `yaml:"trigger" toml:"trigger"`
+	MaxAge          string `yaml:"max_age" toml:"max_age"`
+	LabelMaxAge     string `yaml:"label_max_age" toml:"label_max_age"`
+	ReadTimeout     string `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout    string `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout     string `yaml:"idle_timeout" toml:"idle_timeout"`
+	ShutdownTimeout string `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+type DeadLetter struct {
+	Store string `yaml:"store" toml:"store"`
+	Dir   string `yaml:"dir" toml:"dir"`
+}
+
+// Reply acknowledges the orders to the requesters
+type Reply struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// Template is the file of the reply, the built-in one without it
+	Template string `yaml:"template" toml:"template"`
+	IssueURL bool   `yaml:"issue_url" toml:"issue_url"`
+	Limit    int    `yaml:"limit" toml:"limit"`
+	Window   string `yaml:"window" toml:"window"`
+}
+
+type Order struct {
+	// Prefix starts the order ids, for example DSC for DSC-2026-00123
+	Prefix string `yaml:"prefix" toml:"prefix"`
+}
+
+type Tracing struct {
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	File     string `yaml:"file" toml:"file"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" toml:"level"`
+	Format string `yaml:"format" toml:"format"`
+	File   string `yaml:"file" toml:"file"`
+}
+
+// Load reads and validates the config file, toml files are recognized
+// by their extension, anything else is read as yaml. The settings a
+// command requires are left to the command.
+func Load(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error in reading config file %s", err)
+	}
+	var cfg Config
+	if strings.EqualFold(filepath.Ext(file), ".toml") {
+		md, err := toml.Decode(string(data), &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error in parsing config file %s %s", file, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("error in parsing config file %s: unknown setting %s", file, undecoded[0])
+		}
+	} else if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("error in parsing config file %s %s", file, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s\n%s", file, err)
+	}
+	return &cfg, nil
+}
+
+var (
+	ownerRe      = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]{0,38}$`)
+	repositoryRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,100}$`)
+)
+
+// ValidationError lists every problem of a config
+type ValidationError []string
+
+func (v ValidationError) Error() string {
+	return "  " + strings.Join(v, "\n  ")
+}
+
+// Flags are the command line flags overriding the
+// settings that a command can require
+var Flags = map[string]string{
+	"label":             "label",
+	"github.owner":      "owner",
+	"github.repository": "repository",
+}
+
+// Validate checks the values of the settings and the filters, and that
+// the required settings, keys of Flags, are given. It reports all
+// problems at once.
+func (cfg *Config) Validate(required ...string) error {
+	var errs ValidationError
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	isRequired := func(key string) bool {
+		for _, r := range required {
+			if r == key {
+				return true
+			}
+		}
+		return false
+	}
+	oneOf := func(key, value string, allowed ...string) {
+		if value == "" {
+			return
+		}
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		add("%s: %q should be one of %s", key, value, strings.Join(allowed, ", "))
+	}
+	duration := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			add("%s: %q is not a duration, for example 30s or 1h", key, value)
+		}
+	}
+	port := func(key string, value int) {
+		if value < 0 || value > 65535 {
+			add("%s: %d is not a port", key, value)
+		}
+	}
+
+	switch {
+	case cfg.Label == "":
+		if isRequired("label") {
+			add("label: missing, the gmail label of the order emails")
+		}
+	case strings.HasPrefix(cfg.Label, "/") || strings.HasSuffix(cfg.Label, "/") || strings.Contains(cfg.Label, "//"):
+		add("label: %q has an empty level, nested labels are written as Parent/Child", cfg.Label)
+	}
+	switch {
+	case cfg.Github.Owner == "":
+		if isRequired("github.owner") {
+			add("github.owner: missing")
+		}
+	case !ownerRe.MatchString(cfg.Github.Owner):
+		add("github.owner: %q is not a github user or organization", cfg.Github.Owner)
+	}
+	switch {
+	case cfg.Github.Repository == "":
+		if isRequired("github.repository") {
+			add("github.repository: missing")
+		}
+	case strings.Contains(cfg.Github.Repository, "/"):
+		add("github.repository: %q should only be the name, the owner goes in github.owner", cfg.Github.Repository)
+	case !repositoryRe.MatchString(cfg.Github.Repository) || cfg.Github.Repository == "." || cfg.Github.Repository == "..":
+		add("github.repository: %q is not a github repository name", cfg.Github.Repository)
+	}
+	port("redis.port", cfg.Redis.Port)
+	port("server.port", cfg.Server.Port)
+	oneOf("server.mode", cfg.Server.Mode, "push", "pull")
+	for _, t := range strings.Split(cfg.Server.Trigger, ",") {
+		oneOf("server.trigger", strings.TrimSpace(t), "messageAdded", "labelAdded")
+	}
+	duration("server.max_age", cfg.Server.MaxAge)
+	duration("server.label_max_age", cfg.Server.LabelMaxAge)
+	duration("server.read_timeout", cfg.Server.ReadTimeout)
+	duration("server.write_timeout", cfg.Server.WriteTimeout)
+	duration("server.idle_timeout", cfg.Server.IdleTimeout)
+	duration("server.shutdown_timeout", cfg.Server.ShutdownTimeout)
+	oneOf("deadletter.store", cfg.DeadLetter.Store, "redis", "file", "none")
+	duration("reply.window", cfg.Reply.Window)
+	if cfg.Reply.Limit < 0 {
+		add("reply.limit: %d should not be negative", cfg.Reply.Limit)
+	}
+	oneOf("tracing.exporter", cfg.Tracing.Exporter, "none", "otlp", "stdout")
+	oneOf("log.level", cfg.Log.Level, "debug", "info", "warn", "error")
+	oneOf("log.format", cfg.Log.Format, "text", "json")
+
+	names := make(map[string]bool)
+	for i, f := range cfg.Filters {
+		switch {
+		case f.Name == "":
+			add("filters[%d]: missing name", i)
+		case names[f.Name]:
+			add("filters[%d]: duplicate name %s", i, f.Name)
+		}
+		names[f.Name] = true
+		if f.Empty() {
+			add("filters[%d] %s: needs at least one of from, to, subject, query, negated_query or has_attachment", i, f.Name)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// FilterLabel is the label added by the filter
+func (cfg *Config) FilterLabel(f filters.Filter) string {
+	if f.Label != "" {
+		return f.Label
+	}
+	return cfg.Label
+}
+
+// Values returns the settings that are given in the
+// file, keyed by the name of their command line flag
+func (cfg *Config) Values() map[string]string {
+	v := make(map[string]string)
+	set := func(flag, value string) {
+		if value != "" {
+			v[flag] = value
+		}
+	}
+	setInt := func(flag string, value int) {
+		if value != 0 {
+			v[flag] = strconv.Itoa(value)
+		}
+	}
+	setBool := func(flag string, value bool) {
+		if value {
+			v[flag] = "true"
+		}
+	}
+	set("label", cfg.Label)
+	set("gmail-secret", cfg.Gmail.Secret)
+	set("cache-file", cfg.Gmail.CacheFile)
+	set("gmail-user", cfg.Gmail.User)
+	set("gh-token", cfg.Github.Token)
+	set("owner", cfg.Github.Owner)
+	set("repository", cfg.Github.Repository)
+	set("project", cfg.Pubsub.Project)
+	set("project-id", cfg.Pubsub.Project)
+	set("project-number", cfg.Pubsub.ProjectNumber)
+	set("topic", cfg.Pubsub.Topic)
+	set("subscription", cfg.Pubsub.Subscription)
+	set("endpoint", cfg.Pubsub.Endpoint)
+	set("key-file", cfg.Pubsub.KeyFile)
+	set("dead-letter-topic", cfg.Pubsub.DeadLetterTopic)
+	set("redis-address", cfg.Redis.Address)
+	setInt("redis-port", cfg.Redis.Port)
+	setInt("port", cfg.Server.Port)
+	set("mode", cfg.Server.Mode)
+	set("trigger", cfg.Server.Trigger)
+	set("max-age", cfg.Server.MaxAge)
+	set("label-max-age", cfg.Server.LabelMaxAge)
+	set("read-timeout", cfg.Server.ReadTimeout)
+	set("write-timeout", cfg.Server.WriteTimeout)
+	set("idle-timeout", cfg.Server.IdleTimeout)
+	set("shutdown-timeout", cfg.Server.ShutdownTimeout)
+	set("deadletter-store", cfg.DeadLetter.Store)
+	set("deadletter-dir", cfg.DeadLetter.Dir)
+	setBool("reply", cfg.Reply.Enabled)
+	set("reply-template", cfg.Reply.Template)
+	setBool("reply-issue-url", cfg.Reply.IssueURL)
+	setInt("reply-limit", cfg.Reply.Limit)
+	set("reply-window", cfg.Reply.Window)
+	set("order-prefix", cfg.Order.Prefix)
+	set("trace-exporter", cfg.Tracing.Exporter)
+	set("trace-endpoint", cfg.Tracing.Endpoint)
+	set("trace-file", cfg.Tracing.File)
+	set("log-level", cfg.Log.Level)
+	set("log-format", cfg.Log.Format)
+	set("log-file", cfg.Log.File)
+	return v
+}
+
+// EnvName is the environment variable overriding the flag
+func EnvName(flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// Setting is the resolved value of a flag and where it came from
+type Setting struct {
+	Flag   string
+	Value  string
+	Source string
+}
+
+// Resolve returns the settings of the file, overridden by their
+// environment variables, sorted by flag name. The config can be nil.
+func Resolve(cfg *Config) []Setting {
+	values := make(map[string]string)
+	if cfg != nil {
+		values = cfg.Values()
+	}
+	var settings []Setting
+	for flag, value := range values {
+		settings = append(settings, Setting{flag, value, "file"})
+	}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		flag := strings.ToLower(strings.Replace(strings.TrimPrefix(parts[0], EnvPrefix), "_", "-", -1))
+		if flag == "config" {
+			continue
+		}
+		if _, ok := values[flag]; ok {
+			for i := range settings {
+				if settings[i].Flag == flag {
+					settings[i] = Setting{flag, parts[1], "env"}
+				}
+			}
+			continue
+		}
+		settings = append(settings, Setting{flag, parts[1], "env"})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Flag < settings[j].Flag })
+	return settings
+}
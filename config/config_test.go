@@ -0,0 +1,184 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dictybase/gmail-webhook/filters"
+)
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg := &Config{Label: "Orders/Stock center"}
+		cfg.Github.Owner = "dictybase"
+		cfg.Github.Repository = "orders"
+		return cfg
+	}
+	cases := []struct {
+		name   string
+		change func(cfg *Config)
+		errs   []string
+	}{
+		{"valid", func(cfg *Config) {}, nil},
+		{"missing label", func(cfg *Config) { cfg.Label = "" }, []string{"label: missing"}},
+		{"empty label level", func(cfg *Config) { cfg.Label = "Orders//Stock" }, []string{"label:"}},
+		{"trailing slash", func(cfg *Config) { cfg.Label = "Orders/" }, []string{"label:"}},
+		{"missing owner", func(cfg *Config) { cfg.Github.Owner = "" }, []string{"github.owner: missing"}},
+		{"invalid owner", func(cfg *Config) { cfg.Github.Owner = "-dicty base" }, []string{"github.owner:"}},
+		{"missing repository", func(cfg *Config) { cfg.Github.Repository = "" }, []string{"github.repository: missing"}},
+		{"owner in repository", func(cfg *Config) { cfg.Github.Repository = "dictybase/orders" }, []string{"the owner goes in github.owner"}},
+		{"invalid repository", func(cfg *Config) { cfg.Github.Repository = ".." }, []string{"github.repository:"}},
+		{
+			"all missing",
+			func(cfg *Config) { *cfg = Config{} },
+			[]string{"label: missing", "github.owner: missing", "github.repository: missing"},
+		},
+		{"unknown mode", func(cfg *Config) { cfg.Server.Mode = "poll" }, []string{`server.mode: "poll" should be one of push, pull`}},
+		{"unknown trigger", func(cfg *Config) { cfg.Server.Trigger = "messageAdded,labelRemoved" }, []string{"server.trigger"}},
+		{"invalid duration", func(cfg *Config) { cfg.Server.MaxAge = "1 hour" }, []string{"server.max_age"}},
+		{"invalid port", func(cfg *Config) { cfg.Redis.Port = 70000 }, []string{"redis.port: 70000 is not a port"}},
+		{
+			"filter without name",
+			func(cfg *Config) { cfg.Filters = []filters.Filter{{From: "orders@dictybase.org"}} },
+			[]string{"filters[0]: missing name"},
+		},
+		{
+			"duplicate filter",
+			func(cfg *Config) {
+				cfg.Filters = []filters.Filter{{Name: "orders", From: "a"}, {Name: "orders", To: "b"}}
+			},
+			[]string{"filters[1]: duplicate name orders"},
+		},
+		{
+			"filter without condition",
+			func(cfg *Config) { cfg.Filters = []filters.Filter{{Name: "orders"}} },
+			[]string{"filters[0] orders: needs at least one of"},
+		},
+	}
+	for _, tc := range cases {
+		cfg := valid()
+		tc.change(cfg)
+		err := cfg.Validate("label", "github.owner", "github.repository")
+		if len(tc.errs) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", tc.name, err)
+			}
+			continue
+		}
+		verr, ok := err.(ValidationError)
+		if !ok {
+			t.Errorf("%s: got error %v, want a validation error", tc.name, err)
+			continue
+		}
+		if len(verr) != len(tc.errs) {
+			t.Errorf("%s: got %d errors %q, want %d", tc.name, len(verr), verr, len(tc.errs))
+			continue
+		}
+		for i, want := range tc.errs {
+			if !strings.Contains(verr[i], want) {
+				t.Errorf("%s: got error %q, want it to contain %q", tc.name, verr[i], want)
+			}
+		}
+	}
+}
+
+func TestValidateRequired(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      *Config
+		required []string
+		errs     int
+	}{
+		{"nothing required", &Config{}, nil, 0},
+		{"github required", &Config{Label: "Orders"}, []string{"github.owner", "github.repository"}, 2},
+		{"label given", &Config{Label: "Orders"}, []string{"label"}, 0},
+		{"invalid but not required", &Config{Github: Github{Owner: "-dicty base"}}, nil, 1},
+	}
+	for _, tc := range cases {
+		err := tc.cfg.Validate(tc.required...)
+		if tc.errs == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", tc.name, err)
+			}
+			continue
+		}
+		if verr, ok := err.(ValidationError); !ok || len(verr) != tc.errs {
+			t.Errorf("%s: got error %v, want %d problems", tc.name, err, tc.errs)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	data := "label: Orders/Stock center\ngithub:\n  owner: dictybase\n  repository: orders\nfilters:\n  - name: orders\n    from: orders@dictybase.org\n    archive: true\n"
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Filters) != 1 || cfg.FilterLabel(cfg.Filters[0]) != "Orders/Stock center" || !cfg.Filters[0].Archive {
+		t.Errorf("got config %+v, want the orders filter with the pipeline label", cfg)
+	}
+	// the settings of the pipeline are only required by its commands
+	if err := os.WriteFile(file, []byte("redis:\n  address: redis\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(file); err != nil {
+		t.Errorf("got error %s for a config without the pipeline settings", err)
+	}
+	if err := os.WriteFile(file, []byte("labels: Orders\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(file); err == nil {
+		t.Error("expected an error for an unknown key")
+	}
+}
+
+func TestLoadToml(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	data := "label = \"Orders\"\n[github]\nowner = \"dictybase\"\nrepository = \"orders\"\n[redis]\naddress = \"redis\"\nport = 6380\n[server]\nmode = \"pull\"\n[pubsub]\nkey_file = \"key.json\"\n"
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := cfg.Values()
+	for flag, want := range map[string]string{
+		"label": "Orders", "redis-address": "redis", "redis-port": "6380", "mode": "pull", "key-file": "key.json",
+	} {
+		if values[flag] != want {
+			t.Errorf("got %s %q, want %q", flag, values[flag], want)
+		}
+	}
+	if err := os.WriteFile(file, []byte("[redis]\nhost = \"redis\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(file); err == nil || !strings.Contains(err.Error(), "unknown setting redis.host") {
+		t.Errorf("got error %v, want an unknown setting", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	t.Setenv(EnvName("redis-address"), "cache")
+	t.Setenv(EnvName("log-level"), "debug")
+	cfg := &Config{Label: "Orders", Redis: Redis{Address: "redis"}}
+	got := make(map[string]Setting)
+	for _, s := range Resolve(cfg) {
+		got[s.Flag] = s
+	}
+	for flag, want := range map[string]Setting{
+		"label":         {"label", "Orders", "file"},
+		"redis-address": {"redis-address", "cache", "env"},
+		"log-level":     {"log-level", "debug", "env"},
+	} {
+		if got[flag] != want {
+			t.Errorf("got %+v, want %+v", got[flag], want)
+		}
+	}
+}
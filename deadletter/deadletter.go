@@ -0,0 +1,72 @@
+// Package deadletter persists gmail messages that could not be turned into
+// github issues, so that they can be inspected and replayed once the cause
+// of the failure has been fixed.
+package deadletter
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dictybase/gmail-webhook/history"
+	"google.golang.org/api/gmail/v1"
+)
+
+// ErrNotFound is returned when there is no entry for the message id
+var ErrNotFound = errors.New("no dead-letter entry for message")
+
+// Entry is a failed gmail message
+type Entry struct {
+	// ID is the gmail message id
+	ID          string         `json:"id"`
+	Error       string         `json:"error"`
+	Attempts    int            `json:"attempts"`
+	FirstFailed time.Time      `json:"first_failed"`
+	LastFailed  time.Time      `json:"last_failed"`
+	Message     *gmail.Message `json:"message"`
+}
+
+// Store keeps the dead-letter entries
+type Store interface {
+	// Add records the failure of the message, the attempt
+	// count goes up if the message failed before
+	Add(msg *gmail.Message, cause error) (*Entry, error)
+	// Get returns the entry or ErrNotFound
+	Get(id string) (*Entry, error)
+	// List returns all entries sorted by the time of their last failure
+	List() ([]*Entry, error)
+	// Delete removes the entry, usually after a successful replay
+	Delete(id string) error
+	Close() error
+}
+
+// New opens the store of the given kind, either redis or file. The redis
+// store uses the pool of the history database, the file store the directory.
+func New(kind, dir string, db *history.HistoryDb) (Store, error) {
+	switch kind {
+	case "redis":
+		if db == nil {
+			return nil, errors.New("redis dead-letter store needs the history database")
+		}
+		return NewRedisStore(db), nil
+	case "file":
+		s, err := NewFileStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown dead-letter store %s, should be either redis or file", kind)
+}
+
+func update(e *Entry, msg *gmail.Message, cause error) *Entry {
+	now := time.Now()
+	if e == nil {
+		e = &Entry{ID: msg.Id, FirstFailed: now}
+	}
+	e.Attempts++
+	e.Error = cause.Error()
+	e.LastFailed = now
+	e.Message = msg
+	return e
+}
@@ -0,0 +1,83 @@
+package deadletter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dictybase/gmail-webhook/history"
+	"google.golang.org/api/gmail/v1"
+)
+
+func stores(t *testing.T) map[string]Store {
+	rd := miniredis.RunT(t)
+	db, err := history.NewHistoryDb(rd.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	fs, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"redis": NewRedisStore(db), "file": fs}
+}
+
+func TestStore(t *testing.T) {
+	for name, s := range stores(t) {
+		if _, err := s.Add(&gmail.Message{Id: "m1"}, errors.New("first")); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if _, err := s.Add(&gmail.Message{Id: "m2"}, errors.New("other")); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		e, err := s.Add(&gmail.Message{Id: "m1", Snippet: "retried"}, errors.New("second"))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if e.Attempts != 2 || e.Error != "second" || e.LastFailed.Before(e.FirstFailed) {
+			t.Errorf("%s: got entry %+v, want the second attempt", name, e)
+		}
+
+		e, err = s.Get("m1")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if e.Attempts != 2 || e.Message.Snippet != "retried" {
+			t.Errorf("%s: got stored entry %+v, want the second attempt", name, e)
+		}
+		entries, err := s.List()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if len(entries) != 2 || entries[0].ID != "m2" || entries[1].ID != "m1" {
+			t.Errorf("%s: got %d entries, want m2 and m1 by last failure", name, len(entries))
+		}
+
+		if err := s.Delete("m1"); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if _, err := s.Get("m1"); err != ErrNotFound {
+			t.Errorf("%s: got error %v for a deleted entry, want ErrNotFound", name, err)
+		}
+		if err := s.Delete("m1"); err != ErrNotFound {
+			t.Errorf("%s: got error %v deleting twice, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("memory", "", nil); err == nil {
+		t.Error("expected an error for an unknown store")
+	}
+	if _, err := New("redis", "", nil); err == nil {
+		t.Error("expected an error for a redis store without history database")
+	}
+	s, err := New("file", t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*FileStore); !ok {
+		t.Errorf("got store %T, want a file store", s)
+	}
+}
@@ -0,0 +1,93 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/dictybase/gmail-webhook/history"
+	"github.com/gomodule/redigo/redis"
+	"google.golang.org/api/gmail/v1"
+)
+
+const redisKey = "deadletter"
+
+// RedisStore keeps the entries as json in a redis hash keyed by message id,
+// it shares the connection pool of the history database
+type RedisStore struct {
+	db *history.HistoryDb
+}
+
+func NewRedisStore(db *history.HistoryDb) *RedisStore {
+	return &RedisStore{db: db}
+}
+
+func (s *RedisStore) do(cmd string, args ...interface{}) (interface{}, error) {
+	return s.db.Do(cmd, args...)
+}
+
+func (s *RedisStore) Add(msg *gmail.Message, cause error) (*Entry, error) {
+	e, err := s.Get(msg.Id)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	e = update(e, msg, cause)
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.do("HSET", redisKey, e.ID, b); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (s *RedisStore) Get(id string) (*Entry, error) {
+	b, err := redis.Bytes(s.do("HGET", redisKey, id))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{}
+	return e, json.Unmarshal(b, e)
+}
+
+func (s *RedisStore) List() ([]*Entry, error) {
+	values, err := redis.ByteSlices(s.do("HVALS", redisKey))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for _, b := range values {
+		e := &Entry{}
+		if err := json.Unmarshal(b, e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Sort(byLastFailed(entries))
+	return entries, nil
+}
+
+func (s *RedisStore) Delete(id string) error {
+	n, err := redis.Int(s.do("HDEL", redisKey, id))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Close leaves the pool open, it is closed by the owner of the history database
+func (s *RedisStore) Close() error {
+	return nil
+}
+
+type byLastFailed []*Entry
+
+func (b byLastFailed) Len() int           { return len(b) }
+func (b byLastFailed) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLastFailed) Less(i, j int) bool { return b[i].LastFailed.Before(b[j].LastFailed) }
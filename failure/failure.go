@@ -0,0 +1,184 @@
+package failure
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/google/go-github/github"
+	"google.golang.org/api/googleapi"
+)
+
+// Kind tells whether retrying the failed operation can possibly succeed
+type Kind int
+
+const (
+	// Transient errors are expected to go away on their own, for example
+	// upstream rate limits, upstream 5xx responses or an unavailable redis.
+	// Pub/Sub should redeliver the notification.
+	Transient Kind = iota
+	// Permanent errors will fail the same way on every redelivery, for
+	// example a malformed payload or a subscription mismatch. Pub/Sub
+	// redelivers every push that is not answered with a 2xx, so they are
+	// acknowledged and the failed gmail messages are dead-lettered instead.
+	Permanent
+)
+
+func (k Kind) String() string {
+	if k == Permanent {
+		return "permanent"
+	}
+	return "transient"
+}
+
+// Error wraps an error with its kind and a http status code, the code is
+// sent back to Pub/Sub for transient errors and only reported for permanent ones
+type Error struct {
+	Kind Kind
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Permanentf returns a permanent error with the given http status code
+func Permanentf(code int, format string, args ...interface{}) error {
+	return &Error{Kind: Permanent, Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// Transientf returns a transient error with the given http status code
+func Transientf(code int, format string, args ...interface{}) error {
+	return &Error{Kind: Transient, Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// NewPermanent wraps err as a permanent error
+func NewPermanent(code int, err error) error {
+	return &Error{Kind: Permanent, Code: code, Err: err}
+}
+
+// NewTransient wraps err as a transient error
+func NewTransient(code int, err error) error {
+	return &Error{Kind: Transient, Code: code, Err: err}
+}
+
+// KindOf returns the kind of err, errors that were never
+// classified are considered transient
+func KindOf(err error) Kind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return Transient
+}
+
+// IsPermanent reports whether err should not be retried
+func IsPermanent(err error) bool {
+	return KindOf(err) == Permanent
+}
+
+// StatusCode maps err to the http status code for the Pub/Sub push response,
+// permanent errors are acknowledged with 202 so that they are not redelivered
+func StatusCode(err error) int {
+	e, ok := err.(*Error)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	if e.Kind == Permanent {
+		return http.StatusAccepted
+	}
+	if e.Code != 0 {
+		return e.Code
+	}
+	return http.StatusServiceUnavailable
+}
+
+// Code is the status code describing err, for permanent errors
+// it differs from the acknowledging StatusCode
+func Code(err error) int {
+	if e, ok := err.(*Error); ok && e.Code != 0 {
+		return e.Code
+	}
+	if IsPermanent(err) {
+		return http.StatusBadRequest
+	}
+	return StatusCode(err)
+}
+
+// Write sends err back as a http error response with its mapped status
+// code, the body of an acknowledged permanent error carries its own code
+func Write(w http.ResponseWriter, err error) {
+	code := StatusCode(err)
+	if IsPermanent(err) {
+		http.Error(w, fmt.Sprintf("permanent failure %d: %s", Code(err), err), code)
+		return
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// Gmail classifies an error returned by the gmail api. Rate limits and
+// server errors are transient, any other client error is permanent.
+func Gmail(err error, format string, args ...interface{}) error {
+	msg := annotate(err, format, args...)
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return classifyUpstream(gerr.Code, GmailRateLimited(err), msg)
+	}
+	if _, ok := err.(net.Error); ok {
+		return NewTransient(http.StatusServiceUnavailable, msg)
+	}
+	return NewTransient(http.StatusInternalServerError, msg)
+}
+
+// Github classifies an error returned by the github api. Rate limits and
+// server errors are transient, any other client error is permanent.
+func Github(err error, format string, args ...interface{}) error {
+	msg := annotate(err, format, args...)
+	if gerr, ok := err.(*github.ErrorResponse); ok && gerr.Response != nil {
+		limited := gerr.Response.Header.Get("X-RateLimit-Remaining") == "0"
+		return classifyUpstream(gerr.Response.StatusCode, limited, msg)
+	}
+	if _, ok := err.(net.Error); ok {
+		return NewTransient(http.StatusServiceUnavailable, msg)
+	}
+	return NewTransient(http.StatusInternalServerError, msg)
+}
+
+// Redis classifies an error from the history database, it is
+// always considered transient as redis might be unavailable
+func Redis(err error, format string, args ...interface{}) error {
+	return NewTransient(http.StatusServiceUnavailable, annotate(err, format, args...))
+}
+
+func annotate(err error, format string, args ...interface{}) error {
+	return fmt.Errorf("%s %s", fmt.Sprintf(format, args...), err)
+}
+
+// GmailRateLimited reports whether err is a gmail quota error, gmail
+// signals quota exhaustion with a 429 or a 403 and a rate limit reason
+func GmailRateLimited(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	if gerr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	for _, item := range gerr.Errors {
+		if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+func classifyUpstream(code int, limited bool, err error) error {
+	switch {
+	case code == http.StatusTooManyRequests || limited:
+		return NewTransient(http.StatusServiceUnavailable, err)
+	case code >= http.StatusInternalServerError:
+		return NewTransient(http.StatusBadGateway, err)
+	case code >= http.StatusBadRequest:
+		return NewPermanent(http.StatusUnprocessableEntity, err)
+	}
+	return NewTransient(http.StatusInternalServerError, err)
+}
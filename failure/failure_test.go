@@ -0,0 +1,108 @@
+package failure
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"google.golang.org/api/googleapi"
+)
+
+func githubError(code int, remaining string) error {
+	header := http.Header{}
+	if remaining != "" {
+		header.Set("X-RateLimit-Remaining", remaining)
+	}
+	return &github.ErrorResponse{
+		Response: &http.Response{StatusCode: code, Header: header},
+		Message:  http.StatusText(code),
+	}
+}
+
+func TestGmail(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		kind Kind
+		code int
+	}{
+		{"rate limit", &googleapi.Error{Code: 429}, Transient, http.StatusServiceUnavailable},
+		{
+			"quota",
+			&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}},
+			Transient, http.StatusServiceUnavailable,
+		},
+		{"forbidden", &googleapi.Error{Code: 403}, Permanent, http.StatusAccepted},
+		{"not found", &googleapi.Error{Code: 404}, Permanent, http.StatusAccepted},
+		{"server error", &googleapi.Error{Code: 500}, Transient, http.StatusBadGateway},
+		{"network", &net.DNSError{Err: "no such host"}, Transient, http.StatusServiceUnavailable},
+		{"unknown", errors.New("boom"), Transient, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		err := Gmail(c.err, "error in %s", c.name)
+		if KindOf(err) != c.kind {
+			t.Errorf("%s: expected kind %s, got %s", c.name, c.kind, KindOf(err))
+		}
+		if StatusCode(err) != c.code {
+			t.Errorf("%s: expected status code %d, got %d", c.name, c.code, StatusCode(err))
+		}
+	}
+}
+
+func TestGithub(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		kind Kind
+		code int
+	}{
+		{"rate limit", githubError(403, "0"), Transient, http.StatusServiceUnavailable},
+		{"too many requests", githubError(429, ""), Transient, http.StatusServiceUnavailable},
+		{"forbidden", githubError(403, "4000"), Permanent, http.StatusAccepted},
+		{"validation", githubError(422, ""), Permanent, http.StatusAccepted},
+		{"bad gateway", githubError(502, ""), Transient, http.StatusBadGateway},
+		{"network", &net.DNSError{Err: "no such host"}, Transient, http.StatusServiceUnavailable},
+		{"unknown", errors.New("boom"), Transient, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		err := Github(c.err, "error in %s", c.name)
+		if KindOf(err) != c.kind {
+			t.Errorf("%s: expected kind %s, got %s", c.name, c.kind, KindOf(err))
+		}
+		if StatusCode(err) != c.code {
+			t.Errorf("%s: expected status code %d, got %d", c.name, c.code, StatusCode(err))
+		}
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		code int
+		own  int
+	}{
+		{"permanent", Permanentf(http.StatusUnprocessableEntity, "bad"), http.StatusAccepted, http.StatusUnprocessableEntity},
+		{"permanent without code", NewPermanent(0, errors.New("bad")), http.StatusAccepted, http.StatusBadRequest},
+		{"transient", Transientf(http.StatusBadGateway, "down"), http.StatusBadGateway, http.StatusBadGateway},
+		{"transient without code", NewTransient(0, errors.New("down")), http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"redis", Redis(errors.New("refused"), "error in redis"), http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"unclassified", errors.New("boom"), http.StatusInternalServerError, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		if got := StatusCode(c.err); got != c.code {
+			t.Errorf("%s: expected status code %d, got %d", c.name, c.code, got)
+		}
+		if got := Code(c.err); got != c.own {
+			t.Errorf("%s: expected code %d, got %d", c.name, c.own, got)
+		}
+		w := httptest.NewRecorder()
+		Write(w, c.err)
+		if w.Code != c.code {
+			t.Errorf("%s: expected response code %d, got %d", c.name, c.code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Package filters provisions the gmail filters that apply the label of
+// the pipeline to the order emails. Gmail filters can not be changed, a
+// changed filter is synced by deleting the old one and creating it again.
+package filters
+
+import (
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Filter is the declaration of a gmail filter that
+// adds a label to the matching emails
+type Filter struct {
+	// Name identifies the filter in the output, it is not stored in gmail
+	Name          string `yaml:"name" toml:"name"`
+	From          string `yaml:"from" toml:"from"`
+	To            string `yaml:"to" toml:"to"`
+	Subject       string `yaml:"subject" toml:"subject"`
+	Query         string `yaml:"query" toml:"query"`
+	NegatedQuery  string `yaml:"negated_query" toml:"negated_query"`
+	HasAttachment bool   `yaml:"has_attachment" toml:"has_attachment"`
+	// Label overrides the label of the pipeline
+	Label string `yaml:"label" toml:"label"`
+	// Archive removes the matching emails from the inbox
+	Archive bool `yaml:"archive" toml:"archive"`
+}
+
+// Empty reports whether the filter has no criteria, gmail would reject it
+func (f Filter) Empty() bool {
+	return f.From == "" && f.To == "" && f.Subject == "" &&
+		f.Query == "" && f.NegatedQuery == "" && !f.HasAttachment
+}
+
+// Gmail returns the gmail filter adding the label with the given id
+func (f Filter) Gmail(labelId string) *gmail.Filter {
+	action := &gmail.FilterAction{AddLabelIds: []string{labelId}}
+	if f.Archive {
+		action.RemoveLabelIds = []string{"INBOX"}
+	}
+	return &gmail.Filter{
+		Criteria: &gmail.FilterCriteria{
+			From:          f.From,
+			To:            f.To,
+			Subject:       f.Subject,
+			Query:         f.Query,
+			NegatedQuery:  f.NegatedQuery,
+			HasAttachment: f.HasAttachment,
+		},
+		Action: action,
+	}
+}
+
+// Change is a filter that has to be created or deleted
+type Change struct {
+	// Create is false for a filter that is deleted
+	Create bool
+	Name   string
+	Filter *gmail.Filter
+}
+
+// Manager creates and deletes the filters of a mailbox
+type Manager struct {
+	Client *gmail.Service
+}
+
+func NewManager(client *gmail.Service) *Manager {
+	return &Manager{client}
+}
+
+func (m *Manager) List() ([]*gmail.Filter, error) {
+	resp, err := m.Client.Users.Settings.Filters.List("me").Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Filter, nil
+}
+
+func (m *Manager) Create(f *gmail.Filter) (*gmail.Filter, error) {
+	return m.Client.Users.Settings.Filters.Create("me", f).Do()
+}
+
+func (m *Manager) Delete(id string) error {
+	return m.Client.Users.Settings.Filters.Delete("me", id).Do()
+}
+
+// Plan compares the declared filters with the existing ones. Declared
+// filters that do not exist are created. With prune, existing filters that
+// add one of the managed labels but are not declared are deleted. The
+// declared filters are given with the ids of their labels.
+func (m *Manager) Plan(declared map[string]*gmail.Filter, managed []string, prune bool) ([]Change, error) {
+	existing, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	found := make(map[string]bool)
+	for _, f := range existing {
+		name, ok := lookup(declared, f)
+		if ok {
+			found[name] = true
+			continue
+		}
+		if prune && addsAny(f, managed) {
+			changes = append(changes, Change{Name: f.Id, Filter: f})
+		}
+	}
+	var names []string
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !found[name] {
+			changes = append(changes, Change{Create: true, Name: name, Filter: declared[name]})
+		}
+	}
+	return changes, nil
+}
+
+// Apply carries out the changes of a plan
+func (m *Manager) Apply(changes []Change) error {
+	for _, c := range changes {
+		if c.Create {
+			if _, err := m.Create(c.Filter); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := m.Delete(c.Filter.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func lookup(declared map[string]*gmail.Filter, f *gmail.Filter) (string, bool) {
+	for name, d := range declared {
+		if Equal(d, f) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Equal reports whether both filters have the same criteria and action
+func Equal(a, b *gmail.Filter) bool {
+	ca, cb := criteria(a), criteria(b)
+	if ca.From != cb.From || ca.To != cb.To || ca.Subject != cb.Subject ||
+		ca.Query != cb.Query || ca.NegatedQuery != cb.NegatedQuery ||
+		ca.HasAttachment != cb.HasAttachment {
+		return false
+	}
+	aa, ab := action(a), action(b)
+	return sameIds(aa.AddLabelIds, ab.AddLabelIds) &&
+		sameIds(aa.RemoveLabelIds, ab.RemoveLabelIds)
+}
+
+func criteria(f *gmail.Filter) *gmail.FilterCriteria {
+	if f.Criteria == nil {
+		return &gmail.FilterCriteria{}
+	}
+	return f.Criteria
+}
+
+func action(f *gmail.Filter) *gmail.FilterAction {
+	if f.Action == nil {
+		return &gmail.FilterAction{}
+	}
+	return f.Action
+}
+
+func addsAny(f *gmail.Filter, labelIds []string) bool {
+	for _, id := range action(f).AddLabelIds {
+		for _, l := range labelIds {
+			if id == l {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameIds(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sa := append([]string{}, a...)
+	sb := append([]string{}, b...)
+	sort.Strings(sa)
+	sort.Strings(sb)
+	return strings.Join(sa, ",") == strings.Join(sb, ",")
+}
+
+// Describe is a one line summary of the criteria of a filter
+func Describe(f *gmail.Filter) string {
+	c := criteria(f)
+	var terms []string
+	for _, t := range []struct{ key, value string }{
+		{"from", c.From},
+		{"to", c.To},
+		{"subject", c.Subject},
+		{"query", c.Query},
+		{"negated_query", c.NegatedQuery},
+	} {
+		if t.value != "" {
+			terms = append(terms, t.key+":"+t.value)
+		}
+	}
+	if c.HasAttachment {
+		terms = append(terms, "has_attachment")
+	}
+	return strings.Join(terms, " ")
+}
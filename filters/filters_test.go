@@ -0,0 +1,89 @@
+package filters
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/dictybase/gmail-webhook/testing/fake"
+	"google.golang.org/api/gmail/v1"
+)
+
+func newManager(t *testing.T) *Manager {
+	g := fake.NewGmail()
+	t.Cleanup(g.Close)
+	srv, err := gmail.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.BasePath = g.BasePath()
+	return NewManager(srv)
+}
+
+func TestPlan(t *testing.T) {
+	m := newManager(t)
+	orders := Filter{From: "orders@dictybase.org"}
+	stale := Filter{Subject: "Stock order"}
+	other := Filter{From: "news@dictybase.org"}
+	for _, f := range []*gmail.Filter{orders.Gmail("Label_1"), stale.Gmail("Label_1"), other.Gmail("Label_9")} {
+		if _, err := m.Create(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	declared := map[string]*gmail.Filter{
+		"orders":   orders.Gmail("Label_1"),
+		"archived": Filter{Query: "order", Archive: true}.Gmail("Label_1"),
+	}
+	changes, err := m.Plan(declared, []string{"Label_1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || !changes[0].Create || changes[0].Name != "archived" {
+		t.Fatalf("got changes %+v, want only the archived filter created", changes)
+	}
+	changes, err = m.Plan(declared, []string{"Label_1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Create || Describe(changes[0].Filter) != "subject:Stock order" {
+		t.Fatalf("got changes %+v, want the stale filter deleted and the archived one created", changes)
+	}
+	if err := m.Apply(changes); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = m.Plan(declared, []string{"Label_1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("got changes %+v after applying the plan, want none", changes)
+	}
+	existing, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(existing) != 3 {
+		t.Errorf("got %d filters, want the two declared ones and the unmanaged one", len(existing))
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := &gmail.Filter{
+		Criteria: &gmail.FilterCriteria{From: "orders@dictybase.org"},
+		Action:   &gmail.FilterAction{AddLabelIds: []string{"Label_1", "Label_2"}},
+	}
+	b := &gmail.Filter{
+		Id:       "filter_1",
+		Criteria: &gmail.FilterCriteria{From: "orders@dictybase.org"},
+		Action:   &gmail.FilterAction{AddLabelIds: []string{"Label_2", "Label_1"}},
+	}
+	if !Equal(a, b) {
+		t.Error("expected filters with the same labels in another order to be equal")
+	}
+	b.Action.RemoveLabelIds = []string{"INBOX"}
+	if Equal(a, b) {
+		t.Error("expected an archiving filter to differ")
+	}
+	if !(Filter{}).Empty() || (Filter{HasAttachment: true}).Empty() {
+		t.Error("expected only a filter without criteria to be empty")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import "gopkg.in/urfave/cli.v1"
+
+var keyFileFlag = cli.StringFlag{
+	Name:  "key-file, k",
+	Usage: "service account key file, defaults to GOOGLE_APPLICATION_CREDENTIALS or the application default credentials",
+}
+
+var projectFlag = cli.StringFlag{
+	Name:  "project, p",
+	Usage: "Name of the project",
+}
+
+var cacheFileFlag = cli.StringFlag{
+	Name:   "cache-file, cf",
+	Usage:  "location of cached gmail token file, defaults to ~/.credentials/gmail.json",
+	EnvVar: "CACHE_TOKEN_FILE",
+}
+
+var gmailSecretFlag = cli.StringFlag{
+	Name:  "gmail-secret, gs",
+	Usage: "gmail client secret json file",
+}
+
+var repositoryFlag = cli.StringFlag{
+	Name:  "repository, r",
+	Usage: "Github repository",
+}
+
+var ownerFlag = cli.StringFlag{
+	Name:  "owner",
+	Usage: "Github repository owner",
+}
+
+var orderPrefixFlag = cli.StringFlag{
+	Name:  "order-prefix",
+	Usage: "prefix of the order ids, for example DSC for DSC-2026-00123, empty disables the order ids",
+	Value: "DSC",
+}
+
+// gmailFlags authorize the gmail client, either with the oauth
+// token of gmail-secret or with the google credentials
+var gmailFlags = []cli.Flag{
+	cacheFileFlag,
+	gmailSecretFlag,
+	keyFileFlag,
+	cli.StringFlag{
+		Name:  "gmail-user",
+		Usage: "mailbox impersonated by the service account with domain-wide delegation, used when there is no gmail-secret",
+	},
+	cli.StringFlag{
+		Name:   "gmail-endpoint",
+		Usage:  "base path of the gmail api, only needed for pointing to a fake server",
+		Hidden: true,
+	},
+}
+
+// githubFlags authorize the github client and name the repository of the issues
+var githubFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "gh-token, ght",
+		Usage: "github personal access token file",
+	},
+	repositoryFlag,
+	ownerFlag,
+	cli.StringFlag{
+		Name:   "github-endpoint",
+		Usage:  "base url of the github api, only needed for pointing to a fake server",
+		Hidden: true,
+	},
+}
+
+var redisFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "redis-address",
+		Usage: "IP address of redis-server",
+		Value: "redis",
+	},
+	cli.IntFlag{
+		Name:  "redis-port",
+		Usage: "Port of redis server",
+		Value: 6379,
+	},
+}
+
+var deadLetterFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "deadletter-store",
+		Usage: "where failed orders are kept, one of redis, file or none",
+		Value: "redis",
+	},
+	cli.StringFlag{
+		Name:  "deadletter-dir",
+		Usage: "directory of the file dead-letter store",
+		Value: "deadletter",
+	},
+}
+
+// flags joins the flags of a command with the shared groups
+func flags(groups ...[]cli.Flag) []cli.Flag {
+	var all []cli.Flag
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
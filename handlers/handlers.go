@@ -2,21 +2,43 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/dictybase/gmail-webhook/deadletter"
+	"github.com/dictybase/gmail-webhook/failure"
 	"github.com/dictybase/gmail-webhook/history"
+	"github.com/dictybase/gmail-webhook/labels"
+	"github.com/dictybase/gmail-webhook/logging"
+	"github.com/dictybase/gmail-webhook/mailbox"
+	"github.com/dictybase/gmail-webhook/metrics"
 	"github.com/dictybase/gmail-webhook/middlewares"
+	"github.com/dictybase/gmail-webhook/reply"
+	"github.com/dictybase/gmail-webhook/tracing"
 	"github.com/google/go-github/github"
-	"golang.org/x/net/context"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 )
 
+// Pipeline labels the metrics of the stock order pipeline
+const Pipeline = "stock-order"
+
+// ErrHistoryExpired is returned by GetHistories when gmail no longer keeps
+// the histories after the start id, it keeps them for about a week
+var ErrHistoryExpired = errors.New("start history id is no longer available")
+
 type DscClient struct {
 	Gmail       *gmail.Service
 	Github      *github.Client
@@ -24,8 +46,91 @@ type DscClient struct {
 	Repository  string
 	Owner       string
 	HistoryDbh  *history.HistoryDb
-	Logger      *log.Logger
 	TypeMatcher *regexp.Regexp
+	// MaxAge is the age after which a notification is no longer
+	// considered live and is reconciled from the stored history instead,
+	// zero disables the check
+	MaxAge time.Duration
+	// Stats collects the counters for the status endpoint, can be nil
+	Stats *Stats
+	// DeadLetter keeps the messages that failed to become an issue,
+	// can be nil
+	DeadLetter deadletter.Store
+	// DryRun only writes the issues that would be created to DryRunOutput,
+	// github is never called and the history cursor is not moved
+	DryRun       bool
+	DryRunOutput io.Writer
+	// Triggers are the history types that create an issue, either
+	// mailbox.MessageAdded or mailbox.LabelAdded, defaults to MessageAdded
+	Triggers []string
+	// Mailbox retrieves the histories and messages, it
+	// defaults to a client of Gmail with the default settings
+	Mailbox     *mailbox.Client
+	mailboxOnce sync.Once
+	upstream    upstreamChecks
+	// Replier acknowledges the order to the requester once the
+	// issue is created, nil disables the replies
+	Replier *reply.Replier
+	// OrderPrefix starts the order ids, for example DSC for DSC-2026-00123,
+	// empty disables the order ids
+	OrderPrefix string
+	// Labels resolves the current name of the label for the status
+	// endpoint, can be nil
+	Labels *labels.LabelManager
+	// ClaimLease is how long a message claimed in the ledger is left to
+	// its delivery, defaults to history.DefaultClaimLease
+	ClaimLease time.Duration
+}
+
+// Preview is the issue that would be created for a gmail message
+type Preview struct {
+	MessageID  string   `json:"message_id"`
+	OrderID    string   `json:"order_id,omitempty"`
+	Repository string   `json:"repository"`
+	Title      string   `json:"title"`
+	Body       string   `json:"body"`
+	Labels     []string `json:"labels"`
+}
+
+// PreviewMessage runs the message through the issue generation
+// without creating the issue. With an OrderPrefix the issue shows a
+// placeholder order id, the sequence is left untouched.
+func (dicty *DscClient) PreviewMessage(msg *gmail.Message) (*Preview, error) {
+	issues, err := dicty.GetGithubIssues([]*gmail.Message{msg})
+	if err != nil {
+		return nil, err
+	}
+	if dicty.OrderPrefix == "" {
+		return dicty.newPreview(msg, issues[0]), nil
+	}
+	id := dicty.placeholderOrderID()
+	withOrderID(issues[0], id)
+	p := dicty.newPreview(msg, issues[0])
+	p.OrderID = id
+	return p, nil
+}
+
+func (dicty *DscClient) newPreview(msg *gmail.Message, issue *github.IssueRequest) *Preview {
+	p := &Preview{
+		MessageID:  msg.Id,
+		Repository: dicty.Owner + "/" + dicty.Repository,
+		Title:      *issue.Title,
+		Body:       *issue.Body,
+	}
+	if issue.Labels != nil {
+		p.Labels = *issue.Labels
+	}
+	return p
+}
+
+func (dicty *DscClient) writePreview(p *Preview) error {
+	w := dicty.DryRunOutput
+	if w == nil {
+		w = os.Stdout
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
 }
 
 type user struct {
@@ -33,82 +138,460 @@ type user struct {
 	HistoryID    uint64 `json:"historyId"`
 }
 
-func (dicty *DscClient) StockOrderHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	payload, _ := ctx.Value("payload").(*middlewares.GmailPayload)
+func (dicty *DscClient) StockOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	payload, ok := middlewares.PayloadFromContext(ctx)
+	if !ok {
+		logging.FromContext(ctx).Error("error in retrieving payload from context")
+		failure.Write(w, failure.Transientf(
+			http.StatusInternalServerError,
+			"unable to retrieve payload from context",
+		))
+		return
+	}
+	metrics.NotificationsReceived.WithLabelValues(Pipeline, "push").Inc()
 	data, err := base64.URLEncoding.DecodeString(payload.Message.Data)
 	if err != nil {
-		dicty.Logger.Printf("error in decoding base64 data %s\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		metrics.Error(Pipeline, "decode", metrics.None)
+		logging.FromContext(ctx).Errorf("error in decoding base64 data %s", err)
+		failure.Write(w, failure.NewPermanent(http.StatusBadRequest, err))
 		return
 	}
+	srvMsg, err := dicty.HandleNotification(ctx, data)
+	if err != nil {
+		failure.Write(w, err)
+		return
+	}
+	w.Write([]byte(srvMsg))
+}
+
+// HandleNotification processes a pushed or pulled notification. One
+// published longer than MaxAge ago is reconciled from the stored history
+// instead, the publish time is read from the context.
+func (dicty *DscClient) HandleNotification(ctx context.Context, data []byte) (string, error) {
+	if dicty.isStale(ctx) {
+		logging.FromContext(ctx).Infof(
+			"notification is older than %s, reconciling from stored history",
+			dicty.MaxAge,
+		)
+		return dicty.Reconcile(ctx)
+	}
+	return dicty.ProcessNotification(ctx, data)
+}
+
+func (dicty *DscClient) isStale(ctx context.Context) bool {
+	published, ok := middlewares.PublishTimeFromContext(ctx)
+	if !ok || published.IsZero() || dicty.MaxAge == 0 {
+		return false
+	}
+	return time.Since(published) > dicty.MaxAge
+}
+
+// ProcessNotification runs the json encoded gmail notification through
+// the pipeline and creates the matching github issues. It is shared by the
+// push handler and the pull subscriber, the returned string summarizes
+// the outcome.
+func (dicty *DscClient) ProcessNotification(ctx context.Context, data []byte) (string, error) {
+	dicty.Stats.begin()
+	srvMsg, err := dicty.processNotification(ctx, data)
+	dicty.Stats.end(err)
+	if err == nil {
+		metrics.LastProcessed.WithLabelValues(Pipeline).SetToCurrentTime()
+	}
+	return srvMsg, err
+}
+
+func (dicty *DscClient) processNotification(ctx context.Context, data []byte) (string, error) {
 	var u user
 	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&u); err != nil {
-		dicty.Logger.Printf("error in decoding json data %s\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		metrics.Error(Pipeline, "decode", metrics.None)
+		logging.FromContext(ctx).Errorf("error in decoding json data %s", err)
+		return "", failure.NewPermanent(http.StatusBadRequest, err)
 	}
+	ctx = logging.WithField(ctx, logging.HistoryID, u.HistoryID)
+	logger := logging.FromContext(ctx)
+	_, done := callUpstream(ctx, metrics.Redis, "get_history", "cursor")
 	histId, err := dicty.HistoryDbh.GetCurrentHistory()
+	done(err)
 	if err != nil {
-		dicty.Logger.Printf("error in getting current history %s\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logger.Errorf("error in getting current history %s", err)
+		return "", failure.Redis(err, "error in getting current history")
+	}
+	logger.Infof("current history id %d", histId)
+	histList, err := dicty.GetHistories(ctx, histId)
+	if err == ErrHistoryExpired {
+		return dicty.skipExpiredHistory(ctx, histId)
 	}
-	dicty.Logger.Printf("current history id %d\n", histId)
-	dicty.Logger.Printf("mailbox history id %d\n", u.HistoryID)
-	err = dicty.HistoryDbh.SetCurrentHistory(u.HistoryID)
 	if err != nil {
-		dicty.Logger.Printf("error in setting history %d %s\n", u.HistoryID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logger.Error(err)
+		return "", err
+	}
+	srvMsg, err := dicty.processHistories(ctx, histList)
+	if err != nil {
+		return "", err
+	}
+	// the cursor only moves once the histories are processed, a
+	// redelivery after a transient failure reads them again
+	if u.HistoryID > histId {
+		if err := dicty.setCursor(ctx, u.HistoryID); err != nil {
+			return "", err
+		}
+	}
+	return srvMsg, nil
+}
+
+// Reconcile processes everything recorded after the stored history id
+// without trusting the history id of a notification. A late notification
+// carries an outdated history id, so the stored one is only ever moved
+// forward to the latest history that was processed.
+func (dicty *DscClient) Reconcile(ctx context.Context) (string, error) {
+	dicty.Stats.begin()
+	srvMsg, err := dicty.reconcile(ctx)
+	dicty.Stats.end(err)
+	if err == nil {
+		metrics.LastProcessed.WithLabelValues(Pipeline).SetToCurrentTime()
 	}
+	return srvMsg, err
+}
 
-	histList, err := dicty.GetHistories(histId)
+func (dicty *DscClient) reconcile(ctx context.Context) (string, error) {
+	logger := logging.FromContext(ctx)
+	_, done := callUpstream(ctx, metrics.Redis, "get_history", "cursor")
+	histId, err := dicty.HistoryDbh.GetCurrentHistory()
+	done(err)
 	if err != nil {
-		dicty.Logger.Print(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logger.Errorf("error in getting current history %s", err)
+		return "", failure.Redis(err, "error in getting current history")
+	}
+	histList, err := dicty.GetHistories(ctx, histId)
+	if err == ErrHistoryExpired {
+		return dicty.skipExpiredHistory(ctx, histId)
+	}
+	if err != nil {
+		logger.Error(err)
+		return "", err
 	}
+	srvMsg, err := dicty.processHistories(ctx, histList)
+	if err != nil {
+		return "", err
+	}
+	latest := histId
+	for _, h := range histList {
+		if h.Id > latest {
+			latest = h.Id
+		}
+	}
+	if latest > histId {
+		if err := dicty.setCursor(ctx, latest); err != nil {
+			return "", err
+		}
+		logger.Infof("reconciled history up to %d", latest)
+	}
+	return srvMsg, nil
+}
+
+func (dicty *DscClient) processHistories(ctx context.Context, histList []*gmail.History) (string, error) {
+	logger := logging.FromContext(ctx)
 	if len(histList) == 0 {
-		dicty.Logger.Println("got no history")
-		w.Write([]byte("got no history"))
-		return
+		logger.Info("got no history")
+		return "got no history", nil
 	}
-	log.Printf("got %d histories\n", len(histList))
+	logger.Infof("got %d histories", len(histList))
 
-	messages, err := dicty.GetMatchingMessages(histList)
+	messages, err := dicty.GetMatchingMessages(ctx, histList)
 	if err != nil {
-		dicty.Logger.Print(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logger.Error(err)
+		return "", err
 	}
 	if len(messages) == 0 {
-		dicty.Logger.Println("got no messages matching label")
-		w.Write([]byte("got no messages matching label"))
-		return
+		logger.Info("got no messages matching label")
+		return "got no messages matching label", nil
 	}
-	log.Printf("%d messages matches histories\n", len(messages))
+	logger.Infof("%d messages matches histories", len(messages))
 
-	issues, err := dicty.GetGithubIssues(messages)
+	var created, skipped, failed int
+	for _, msg := range messages {
+		mctx := logging.WithField(ctx, logging.GmailMessageID, msg.Id)
+		ok, err := dicty.ProcessMessage(mctx, msg)
+		if err == nil {
+			if ok {
+				created++
+			} else {
+				skipped++
+			}
+			continue
+		}
+		// transient errors fail the whole notification so that it is
+		// redelivered, the ledger skips the issues already created. Without
+		// a dead-letter store every error does, a dry run never writes to it.
+		if !failure.IsPermanent(err) || dicty.DeadLetter == nil || dicty.DryRun {
+			return "", err
+		}
+		if err := dicty.deadLetter(mctx, msg, err); err != nil {
+			return "", err
+		}
+		failed++
+	}
+	verb := "created"
+	if dicty.DryRun {
+		verb = "would create"
+	}
+	srvMsg := fmt.Sprintf("%s %d issues", verb, created)
+	if skipped > 0 {
+		srvMsg = fmt.Sprintf("%s, %d already filed", srvMsg, skipped)
+	}
+	if failed > 0 {
+		srvMsg = fmt.Sprintf("%s, %d dead-lettered", srvMsg, failed)
+	}
+	logger.Info(srvMsg)
+	return srvMsg, nil
+}
+
+// skipExpiredHistory moves the cursor to the current history id of the
+// mailbox when gmail no longer has the histories after it, otherwise every
+// notification would fail on it for good. The orders that arrived in the gap
+// are not processed, they are filed by running backfill.
+func (dicty *DscClient) skipExpiredHistory(ctx context.Context, histId uint64) (string, error) {
+	logger := logging.FromContext(ctx)
+	pctx, done := callUpstream(ctx, metrics.Gmail, "users.getProfile", "cursor")
+	profile, err := dicty.Gmail.Users.GetProfile("me").Context(pctx).Do()
+	done(err)
 	if err != nil {
-		dicty.Logger.Print(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logger.Errorf("error in retrieving current history of mailbox %s", err)
+		return "", failure.Gmail(err, "error in retrieving current history of mailbox")
 	}
-	for _, gs := range issues {
-		_, _, err := dicty.Github.Issues.Create(
-			dicty.Owner,
-			dicty.Repository,
-			gs,
-		)
+	metrics.HistoryGaps.WithLabelValues(Pipeline).Inc()
+	logger.Errorf(
+		"history %d has expired, skipping to the current history %d, run backfill for the orders in between",
+		histId, profile.HistoryId,
+	)
+	if err := dicty.setCursor(ctx, profile.HistoryId); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("history %d expired, moved cursor to %d", histId, profile.HistoryId), nil
+}
+
+// setCursor moves the stored history id, it is left untouched in dry-run
+func (dicty *DscClient) setCursor(ctx context.Context, id uint64) error {
+	if dicty.DryRun {
+		logging.FromContext(ctx).Infof("dry run, leaving history cursor before %d", id)
+		return nil
+	}
+	_, done := callUpstream(ctx, metrics.Redis, "set_history", "cursor")
+	err := dicty.HistoryDbh.SetCurrentHistory(id)
+	done(err)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("error in setting history %d %s", id, err)
+		return failure.Redis(err, "error in setting history %d", id)
+	}
+	return nil
+}
+
+// ProcessMessage turns a single gmail message into a github issue and
+// reports whether one was created. Messages the idempotency ledger already
+// knows are skipped. In dry-run the issue is written to DryRunOutput
+// instead. It is shared by the notification pipeline, the backfill and the
+// dead-letter replay.
+func (dicty *DscClient) ProcessMessage(ctx context.Context, msg *gmail.Message) (filed bool, err error) {
+	logger := logging.FromContext(ctx)
+	if dicty.HistoryDbh != nil {
+		claim, known, cerr := dicty.claim(ctx, msg.Id)
+		if cerr != nil {
+			return false, cerr
+		}
+		if known {
+			logger.Info("message is already filed as an issue, skipping")
+			return false, nil
+		}
+		if claim != nil && claim.Stale {
+			logger.Warn("taking over the expired claim of an earlier delivery")
+		}
+		if claim != nil {
+			// a message that could not be filed can be claimed again
+			defer func() {
+				if err == nil {
+					return
+				}
+				_, done := callUpstream(ctx, metrics.Redis, "release_message", "ledger")
+				rerr := dicty.HistoryDbh.ReleaseMessage(msg.Id, claim)
+				done(rerr)
+				if rerr != nil {
+					logger.Errorf("error in releasing message in ledger %s", rerr)
+				}
+			}()
+		}
+	}
+	issues, err := dicty.GetGithubIssues([]*gmail.Message{msg})
+	if err != nil {
+		metrics.Error(Pipeline, "parse", metrics.None)
+		logger.Error(err)
+		return false, err
+	}
+	summary := *issues[0].Body
+	order, err := dicty.orderOf(ctx, msg)
+	if err != nil {
+		logger.Error(err)
+		return false, err
+	}
+	if order != nil {
+		withOrderID(issues[0], order.ID)
+		ctx = logging.WithField(ctx, logging.OrderID, order.ID)
+		logger = logging.FromContext(ctx)
+	}
+	if dicty.DryRun {
+		logger.Infof("dry run, not creating issue %q", *issues[0].Title)
+		p := dicty.newPreview(msg, issues[0])
+		if order != nil {
+			p.OrderID = order.ID
+		}
+		return true, dicty.writePreview(p)
+	}
+	ictx, done := callUpstream(
+		ctx, metrics.Github, "issues.create", "issues",
+		attribute.String("github.repository", dicty.Owner+"/"+dicty.Repository),
+	)
+	issue, _, err := dicty.Github.Issues.Create(
+		ictx,
+		dicty.Owner,
+		dicty.Repository,
+		issues[0],
+	)
+	done(err)
+	if err != nil {
+		logger.Errorf("error in creating github issue %s", err)
+		return false, failure.Github(err, "error in creating github issue")
+	}
+	dicty.Stats.issueCreated()
+	metrics.IssuesCreated.WithLabelValues(Pipeline).Inc()
+	logger.Infof("created github issue %d", *issue.Number)
+	if dicty.HistoryDbh != nil {
+		_, done := callUpstream(ctx, metrics.Redis, "mark_processed", "ledger")
+		err := dicty.HistoryDbh.MarkProcessed(msg.Id, *issue.Number)
+		done(err)
+		// the issue exists, failing now would only file it twice
 		if err != nil {
-			dicty.Logger.Println("error in creating github issue %s\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			logger.Errorf("error in recording message in ledger %s", err)
 		}
 	}
-	srvMsg := fmt.Sprintf("created %d issues", len(issues))
-	log.Println(srvMsg)
-	w.Write([]byte(srvMsg))
+	reference := strconv.Itoa(*issue.Number)
+	if order != nil {
+		reference = order.ID
+		order.Repository = dicty.Owner + "/" + dicty.Repository
+		order.Issue = *issue.Number
+		if issue.HTMLURL != nil {
+			order.IssueURL = *issue.HTMLURL
+		}
+		_, done := callUpstream(ctx, metrics.Redis, "save_order", "order")
+		err := dicty.HistoryDbh.SaveOrder(order)
+		done(err)
+		if err != nil {
+			logger.Errorf("error in recording issue in order index %s", err)
+		}
+	}
+	dicty.acknowledge(ctx, msg, issue, reference, summary)
+	return true, nil
+}
+
+// claim tells whether the message is already known to the ledger, otherwise
+// it is claimed as pending so that no concurrent delivery files it as well.
+// A dry run only looks it up and returns no claim.
+func (dicty *DscClient) claim(ctx context.Context, msgId string) (*history.Claim, bool, error) {
+	if dicty.DryRun {
+		_, done := callUpstream(ctx, metrics.Redis, "is_processed", "ledger")
+		known, err := dicty.HistoryDbh.IsProcessed(msgId)
+		done(err)
+		if err != nil {
+			return nil, false, failure.Redis(err, "error in looking up message %s in ledger", msgId)
+		}
+		return nil, known, nil
+	}
+	lease := dicty.ClaimLease
+	if lease == 0 {
+		lease = history.DefaultClaimLease
+	}
+	_, done := callUpstream(ctx, metrics.Redis, "claim_message", "ledger")
+	claim, err := dicty.HistoryDbh.ClaimMessage(msgId, lease)
+	done(err)
+	if err != nil {
+		return nil, false, failure.Redis(err, "error in claiming message %s in ledger", msgId)
+	}
+	return claim, claim == nil, nil
+}
+
+// orderOf returns the order of the message from the index, with a new id
+// from the sequence unless it got one before. A dry run only shows a
+// placeholder id and leaves the sequence untouched.
+func (dicty *DscClient) orderOf(ctx context.Context, msg *gmail.Message) (*history.Order, error) {
+	if dicty.OrderPrefix == "" {
+		return nil, nil
+	}
+	if dicty.DryRun || dicty.HistoryDbh == nil {
+		return &history.Order{ID: dicty.placeholderOrderID(), MessageID: msg.Id}, nil
+	}
+	_, done := callUpstream(ctx, metrics.Redis, "order_id", "order")
+	id, err := dicty.HistoryDbh.OrderID(msg.Id, dicty.OrderPrefix, time.Now().Year())
+	done(err)
+	if err != nil {
+		return nil, failure.Redis(err, "error in assigning order id to message %s", msg.Id)
+	}
+	order, err := dicty.HistoryDbh.GetOrder(id)
+	if err == history.ErrOrderNotFound {
+		order = &history.Order{
+			ID:        id,
+			MessageID: msg.Id,
+			ThreadID:  msg.ThreadId,
+			Created:   time.Now(),
+		}
+		err = dicty.HistoryDbh.SaveOrder(order)
+	}
+	if err != nil {
+		return nil, failure.Redis(err, "error in indexing order %s", id)
+	}
+	return order, nil
+}
+
+// placeholderOrderID stands in for the order id of the
+// current year, for example DSC-2026-?????
+func (dicty *DscClient) placeholderOrderID() string {
+	return fmt.Sprintf("%s-%d-?????", dicty.OrderPrefix, time.Now().Year())
+}
+
+// withOrderID puts the order id in the title and on top of the body of the issue
+func withOrderID(issue *github.IssueRequest, id string) {
+	title := fmt.Sprintf("[%s] %s", id, *issue.Title)
+	body := fmt.Sprintf("Order ID: %s\n\n%s", id, *issue.Body)
+	issue.Title = &title
+	issue.Body = &body
+}
+
+// deadLetter keeps the permanently failed message for a later replay,
+// a redelivery would only fail on it again and hold back the cursor
+func (dicty *DscClient) deadLetter(ctx context.Context, msg *gmail.Message, cause error) error {
+	e, err := dicty.DeadLetter.Add(msg, cause)
+	if err != nil {
+		metrics.Error(Pipeline, "deadletter", metrics.None)
+		logging.FromContext(ctx).Errorf("error in storing dead-letter entry %s", err)
+		return failure.NewTransient(http.StatusServiceUnavailable, err)
+	}
+	logging.FromContext(ctx).
+		WithField("attempts", e.Attempts).
+		Warnf("dead-lettered message after error %s", cause)
+	return nil
+}
+
+// callUpstream starts a span for a call to an upstream service. The returned
+// function ends it and records the latency of the call and, on error, the
+// failed stage of the pipeline.
+func callUpstream(ctx context.Context, upstream, operation, stage string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, upstream+" "+operation, attrs...)
+	return ctx, func(err error) {
+		metrics.ObserveUpstream(upstream, operation, start)
+		if err != nil {
+			metrics.Error(Pipeline, stage, upstream)
+		}
+		tracing.End(span, err)
+	}
 }
 
 func (dicty *DscClient) MatchLabel(labels []string) bool {
@@ -120,44 +603,129 @@ func (dicty *DscClient) MatchLabel(labels []string) bool {
 	return false
 }
 
-func (dicty *DscClient) GetHistories(id uint64) ([]*gmail.History, error) {
-	pageToken := ""
-	var histList []*gmail.History
-	for {
-		histListCall := gmail.NewUsersHistoryService(
-			dicty.Gmail).
-			List("me").
-			StartHistoryId(id)
-		if pageToken != "" {
-			histListCall = histListCall.PageToken(pageToken)
+// GetHistories returns the histories of the label after the given
+// history id, gmail filters them on the label and the trigger types. It
+// returns ErrHistoryExpired when gmail answers with a 404 for the id.
+func (dicty *DscClient) GetHistories(ctx context.Context, id uint64) ([]*gmail.History, error) {
+	histList, err := dicty.mailbox().History(ctx, id, dicty.Label, dicty.triggers()...)
+	metrics.HistoriesFetched.WithLabelValues(Pipeline).Add(float64(len(histList)))
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+		return histList, ErrHistoryExpired
+	}
+	if err != nil {
+		return histList, failure.Gmail(err, "error in making history call")
+	}
+	return histList, nil
+}
+
+// GetMatchingMessages retrieves the messages of the histories that were
+// added or labeled, depending on the triggers, and carry the label. Every
+// message is retrieved once, the labels recorded in the history are trusted
+// and only messages without them are looked up in the metadata format. The
+// matching messages are then retrieved in full.
+func (dicty *DscClient) GetMatchingMessages(ctx context.Context, histList []*gmail.History) ([]*gmail.Message, error) {
+	logger := logging.FromContext(ctx)
+	added := mailbox.Triggered(histList, dicty.Label, dicty.triggers()...)
+	var unknown []string
+	for _, m := range added {
+		if len(m.LabelIds) == 0 {
+			unknown = append(unknown, m.Id)
 		}
-		respList, err := histListCall.Do()
+	}
+	labelIds := make(map[string][]string)
+	if len(unknown) > 0 {
+		metas, err := dicty.fetchMessages(ctx, unknown, mailbox.FormatMetadata)
 		if err != nil {
-			return histList, fmt.Errorf("error in making history call %s\r", err)
+			return nil, err
 		}
-		histList = append(histList, respList.History...)
-		if respList.NextPageToken == "" {
-			return histList, nil
+		for _, m := range metas {
+			labelIds[m.Id] = m.LabelIds
 		}
-		pageToken = respList.NextPageToken
 	}
-	return histList, nil
+	var ids []string
+	for _, m := range added {
+		lids, ok := labelIds[m.Id]
+		if !ok {
+			lids = m.LabelIds
+		}
+		if dicty.MatchLabel(lids) {
+			metrics.MessagesMatched.WithLabelValues(Pipeline).Inc()
+			ids = append(ids, m.Id)
+			continue
+		}
+		metrics.MessagesSkipped.WithLabelValues(Pipeline).Inc()
+		logger.WithField(logging.GmailMessageID, m.Id).Debug("message does not match label")
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return dicty.fetchMessages(ctx, ids, mailbox.FormatFull)
 }
 
-func (dicty *DscClient) GetMatchingMessages(histList []*gmail.History) ([]*gmail.Message, error) {
-	var messages []*gmail.Message
-	for _, h := range histList {
-		for _, m := range h.Messages {
-			msg, err := dicty.Gmail.Users.Messages.Get("me", m.Id).Do()
-			if err != nil {
-				return messages, fmt.Errorf("error in retrieving message %s %s", m.Id, err)
-			}
-			if dicty.MatchLabel(msg.LabelIds) {
-				messages = append(messages, msg)
+// fetchMessages retrieves the messages in the format. A message that
+// permanently fails to be retrieved, for example because it was deleted,
+// is dead-lettered by its id and skipped, otherwise the cursor could
+// never move past it. Other errors are returned for a redelivery.
+func (dicty *DscClient) fetchMessages(ctx context.Context, ids []string, format string) ([]*gmail.Message, error) {
+	for len(ids) > 0 {
+		messages, err := dicty.mailbox().Messages(ctx, ids, format)
+		if err == nil {
+			return messages, nil
+		}
+		ferr := gmailMessageError(err)
+		merr, ok := err.(*mailbox.MessageError)
+		if !ok || !failure.IsPermanent(ferr) || dicty.DeadLetter == nil || dicty.DryRun {
+			return nil, ferr
+		}
+		mctx := logging.WithField(ctx, logging.GmailMessageID, merr.ID)
+		if err := dicty.deadLetter(mctx, &gmail.Message{Id: merr.ID}, ferr); err != nil {
+			return nil, err
+		}
+		var rest []string
+		for _, id := range ids {
+			if id != merr.ID {
+				rest = append(rest, id)
 			}
 		}
+		ids = rest
 	}
-	return messages, nil
+	return nil, nil
+}
+
+func gmailMessageError(err error) error {
+	if merr, ok := err.(*mailbox.MessageError); ok {
+		return failure.Gmail(merr.Err, "error in retrieving message %s", merr.ID)
+	}
+	return failure.Gmail(err, "error in retrieving messages")
+}
+
+func (dicty *DscClient) triggers() []string {
+	if len(dicty.Triggers) == 0 {
+		return []string{mailbox.MessageAdded}
+	}
+	return dicty.Triggers
+}
+
+// mailbox returns the gmail access layer, instrumented
+// with the metrics and traces of the pipeline
+func (dicty *DscClient) mailbox() *mailbox.Client {
+	dicty.mailboxOnce.Do(func() {
+		if dicty.Mailbox == nil {
+			dicty.Mailbox = mailbox.New(dicty.Gmail)
+		}
+		if dicty.Mailbox.Observe == nil {
+			dicty.Mailbox.Observe = observeGmail
+		}
+	})
+	return dicty.Mailbox
+}
+
+func observeGmail(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	stage := "messages"
+	if operation == "history.list" {
+		stage = "history"
+	}
+	return callUpstream(ctx, metrics.Gmail, operation, stage, attrs...)
 }
 
 func (dicty *DscClient) GetGithubIssues(msgs []*gmail.Message) ([]*github.IssueRequest, error) {
@@ -166,7 +734,11 @@ func (dicty *DscClient) GetGithubIssues(msgs []*gmail.Message) ([]*github.IssueR
 		title := parseSubject(msg.Payload)
 		body, err := parseBody(msg.Payload)
 		if err != nil {
-			return issues, fmt.Errorf("error in parsing body %s\n", err)
+			return issues, failure.Permanentf(
+				http.StatusUnprocessableEntity,
+				"error in parsing body of message %s %s",
+				msg.Id, err,
+			)
 		}
 		matches := dicty.TypeMatcher.FindStringSubmatch(body)
 		if matches == nil {
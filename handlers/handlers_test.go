@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dictybase/gmail-webhook/middlewares"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestIsStale(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name   string
+		ctx    context.Context
+		maxAge time.Duration
+		want   bool
+	}{
+		{"no publish time", context.Background(), time.Minute, false},
+		{"zero publish time", middlewares.WithDelivery(context.Background(), time.Time{}, 0), time.Minute, false},
+		{"check disabled", middlewares.WithDelivery(context.Background(), now.Add(-time.Hour), 0), 0, false},
+		{"live", middlewares.WithDelivery(context.Background(), now, 1), time.Minute, false},
+		{"stale", middlewares.WithDelivery(context.Background(), now.Add(-time.Hour), 5), time.Minute, true},
+	}
+	for _, c := range cases {
+		dsc := &DscClient{MaxAge: c.maxAge}
+		if got := dsc.isStale(c.ctx); got != c.want {
+			t.Errorf("%s: got %t, want %t", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPreviewMessage(t *testing.T) {
+	msg := &gmail.Message{
+		Id: "m1",
+		Payload: &gmail.MessagePart{
+			MimeType: "text/plain",
+			Headers:  []*gmail.MessagePartHeader{{Name: "Subject", Value: "Stock order"}},
+			Body: &gmail.MessagePartBody{
+				Data: base64.URLEncoding.EncodeToString([]byte("Order_Type:strain|none")),
+			},
+		},
+	}
+	placeholder := fmt.Sprintf("DSC-%d-?????", time.Now().Year())
+	cases := []struct {
+		name    string
+		prefix  string
+		orderId string
+		title   string
+	}{
+		{"without order ids", "", "", "Stock order"},
+		{"with order ids", "DSC", placeholder, "[" + placeholder + "] Stock order"},
+	}
+	for _, c := range cases {
+		dsc := &DscClient{
+			Owner:       "dictybase",
+			Repository:  "orders",
+			TypeMatcher: regexp.MustCompile(`Order_Type:(\w+)\|(\w+)`),
+			OrderPrefix: c.prefix,
+		}
+		p, err := dsc.PreviewMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.OrderID != c.orderId {
+			t.Errorf("%s: got order id %q, want %q", c.name, p.OrderID, c.orderId)
+		}
+		if p.Title != c.title {
+			t.Errorf("%s: got title %q, want %q", c.name, p.Title, c.title)
+		}
+		if c.orderId != "" && !strings.HasPrefix(p.Body, "Order ID: "+c.orderId) {
+			t.Errorf("%s: got body %q, want the order id on top", c.name, p.Body)
+		}
+		if len(p.Labels) != 1 || p.Labels[0] != "Strain Order" {
+			t.Errorf("%s: got labels %v, want Strain Order", c.name, p.Labels)
+		}
+	}
+}
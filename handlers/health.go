@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const checkTimeout = 5 * time.Second
+
+// upstreamTTL is how long the result of the gmail and github token
+// checks is reused, the probes come far more often than tokens expire
+const upstreamTTL = time.Minute
+
+type check struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready  bool             `json:"ready"`
+	Checks map[string]check `json:"checks"`
+	Watch  *watchState      `json:"watch"`
+}
+
+// watchState is reported by the probes without failing them, an
+// expired watch is fixed by running the watch command, not by a restart
+type watchState struct {
+	Expiration *time.Time `json:"expiration,omitempty"`
+	ExpiresIn  string     `json:"expires_in,omitempty"`
+	Expired    bool       `json:"expired"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// upstreamChecks caches the last gmail and github token checks
+type upstreamChecks struct {
+	mu      sync.Mutex
+	checked time.Time
+	gmail   error
+	github  error
+}
+
+// status reports null history ids until the
+// watch and the first notification store them
+type status struct {
+	Label          string      `json:"label,omitempty"`
+	CurrentHistory *uint64     `json:"current_history"`
+	StartHistory   *uint64     `json:"start_history"`
+	Watch          *watchState `json:"watch"`
+	StatsSnapshot
+}
+
+// HealthHandler reports that the process is alive
+func (dicty *DscClient) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// ReadyHandler checks that redis is reachable and that the gmail and github
+// tokens are valid, the token checks are cached for a minute. It responds
+// with 503 if any of the checks fails. The state of the gmail watch is
+// reported as well but does not affect the readiness.
+func (dicty *DscClient) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+	rd := &readiness{Ready: true, Checks: make(map[string]check)}
+	rd.add("redis", dicty.HistoryDbh.Ping())
+	gmailErr, githubErr := dicty.checkUpstreams(ctx)
+	rd.add("gmail", gmailErr)
+	rd.add("github", githubErr)
+	rd.Watch = dicty.watchState()
+	code := http.StatusOK
+	if !rd.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, rd)
+}
+
+// StatusHandler reports the current name of the label, the stored
+// history ids and the pipeline counters
+func (dicty *DscClient) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	st := &status{StatsSnapshot: dicty.Stats.Snapshot(), Watch: dicty.watchState()}
+	if dicty.Labels != nil {
+		st.Label = dicty.Labels.Id2Name(dicty.Label)
+	}
+	var err error
+	st.CurrentHistory, err = storedHistory(dicty.HistoryDbh.GetCurrentHistory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	st.StartHistory, err = storedHistory(dicty.HistoryDbh.GetStartHistory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// storedHistory reads a history id, it is nil when none is stored yet
+func storedHistory(get func() (uint64, error)) (*uint64, error) {
+	id, err := get()
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// checkUpstreams validates the gmail and github tokens, unless they were
+// checked within the upstreamTTL. Concurrent probes wait for a single check.
+func (dicty *DscClient) checkUpstreams(ctx context.Context) (error, error) {
+	u := &dicty.upstream
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.checked.IsZero() && time.Since(u.checked) < upstreamTTL {
+		return u.gmail, u.github
+	}
+	_, u.gmail = dicty.Gmail.Users.GetProfile("me").Context(ctx).Do()
+	_, _, u.github = dicty.Github.RateLimits(ctx)
+	u.checked = time.Now()
+	return u.gmail, u.github
+}
+
+// watchState reads the stored expiration of the gmail watch
+func (dicty *DscClient) watchState() *watchState {
+	ws := &watchState{}
+	ok, err := dicty.HistoryDbh.HasWatchExpiration()
+	if err != nil {
+		ws.Error = err.Error()
+		return ws
+	}
+	if !ok {
+		ws.Expired = true
+		ws.Error = "no gmail watch is stored, run the watch command"
+		return ws
+	}
+	expiration, err := dicty.HistoryDbh.GetWatchExpiration()
+	if err != nil {
+		ws.Error = err.Error()
+		return ws
+	}
+	remaining := time.Until(expiration)
+	ws.Expiration = &expiration
+	ws.ExpiresIn = remaining.String()
+	if remaining <= 0 {
+		ws.Expired = true
+		ws.Error = "gmail watch has expired, run the watch command"
+	}
+	return ws
+}
+
+func (rd *readiness) add(name string, err error) {
+	if err != nil {
+		rd.Ready = false
+		rd.Checks[name] = check{Error: err.Error()}
+		return
+	}
+	rd.Checks[name] = check{OK: true}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dictybase/gmail-webhook/history"
+	"github.com/dictybase/gmail-webhook/labels"
+	"github.com/dictybase/gmail-webhook/testing/fake"
+	"github.com/google/go-github/github"
+	"google.golang.org/api/gmail/v1"
+)
+
+// newHealthClient returns a client wired to the fakes and to miniredis
+func newHealthClient(t *testing.T) (*DscClient, *miniredis.Miniredis) {
+	g := fake.NewGmail()
+	t.Cleanup(g.Close)
+	g.AddLabel("Label_1", "Orders")
+	gh := fake.NewGithub()
+	t.Cleanup(gh.Close)
+	gm, err := gmail.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gm.BasePath = g.BasePath()
+	ghc := github.NewClient(nil)
+	ghc.BaseURL, err = url.Parse(gh.BaseURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := miniredis.RunT(t)
+	hdb, err := history.NewHistoryDb(rd.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hdb.Close() })
+	return &DscClient{
+		Gmail:      gm,
+		Github:     ghc,
+		Label:      "Label_1",
+		HistoryDbh: hdb,
+		Stats:      NewStats(),
+	}, rd
+}
+
+func get(t *testing.T, h http.HandlerFunc, v interface{}) int {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	if v != nil {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+func TestHealthHandler(t *testing.T) {
+	dsc, _ := newHealthClient(t)
+	if code := get(t, dsc.HealthHandler, nil); code != http.StatusOK {
+		t.Errorf("got status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	cases := []struct {
+		name    string
+		expiry  time.Duration
+		watch   bool
+		expired bool
+	}{
+		{"ready", time.Hour, true, false},
+		{"watch expired", -time.Hour, true, true},
+		{"no watch", 0, false, true},
+	}
+	for _, c := range cases {
+		dsc, _ := newHealthClient(t)
+		if c.watch {
+			ms := time.Now().Add(c.expiry).UnixNano() / int64(time.Millisecond)
+			if err := dsc.HistoryDbh.SetWatchExpiration(ms); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the watch is reported but does not fail the readiness
+		var rd readiness
+		if code := get(t, dsc.ReadyHandler, &rd); code != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d %v", c.name, code, http.StatusOK, rd.Checks)
+		}
+		for name, ch := range rd.Checks {
+			if !ch.OK {
+				t.Errorf("%s: got failed check %s %+v", c.name, name, ch)
+			}
+		}
+		if rd.Watch == nil || rd.Watch.Expired != c.expired {
+			t.Errorf("%s: got watch %+v, want expired %t", c.name, rd.Watch, c.expired)
+		}
+	}
+}
+
+func TestReadyHandlerWithoutRedis(t *testing.T) {
+	dsc, rd := newHealthClient(t)
+	rd.Close()
+	var ready readiness
+	if code := get(t, dsc.ReadyHandler, &ready); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if ready.Checks["redis"].OK {
+		t.Error("got a passing redis check with redis down")
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	dsc, rd := newHealthClient(t)
+	// nothing is stored before the watch and the first notification
+	var empty status
+	if code := get(t, dsc.StatusHandler, &empty); code != http.StatusOK {
+		t.Fatalf("got status %d without stored history ids, want %d", code, http.StatusOK)
+	}
+	if empty.StartHistory != nil || empty.CurrentHistory != nil {
+		t.Errorf("got start %v and current %v, want null history ids", empty.StartHistory, empty.CurrentHistory)
+	}
+	if err := dsc.HistoryDbh.AddStartHistory(1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := dsc.HistoryDbh.SetCurrentHistory(1002); err != nil {
+		t.Fatal(err)
+	}
+	dsc.Labels = labels.NewLabelManager(dsc.Gmail)
+	dsc.Stats.begin()
+	dsc.Stats.issueCreated()
+	dsc.Stats.end(nil)
+	var st status
+	if code := get(t, dsc.StatusHandler, &st); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if st.Label != "Orders" {
+		t.Errorf("got label %q, want Orders", st.Label)
+	}
+	if st.StartHistory == nil || *st.StartHistory != 1000 || st.CurrentHistory == nil || *st.CurrentHistory != 1002 {
+		t.Errorf("got start %v and current %v, want 1000 and 1002", st.StartHistory, st.CurrentHistory)
+	}
+	if st.IssuesCreated != 1 || st.QueueDepth != 0 || st.LastProcessed.IsZero() {
+		t.Errorf("got counters %+v, want one created issue", st.StatsSnapshot)
+	}
+	rd.Close()
+	if code := get(t, dsc.StatusHandler, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d without redis, want %d", code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dictybase/gmail-webhook/logging"
+	"github.com/dictybase/gmail-webhook/metrics"
+	"github.com/dictybase/gmail-webhook/reply"
+	"github.com/google/go-github/github"
+	"google.golang.org/api/gmail/v1"
+)
+
+// acknowledge replies to the requester on the thread of the order with the
+// reference and the summary of the order. The issue exists at this point,
+// so a failed reply is only logged.
+func (dicty *DscClient) acknowledge(ctx context.Context, msg *gmail.Message, issue *github.Issue, reference, summary string) {
+	if dicty.Replier == nil {
+		return
+	}
+	result, err := dicty.sendReply(ctx, msg, issue, reference, summary)
+	metrics.Replies.WithLabelValues(Pipeline, result).Inc()
+	logger := logging.FromContext(ctx)
+	switch result {
+	case reply.Sent:
+		logger.Info("sent acknowledgement to the requester")
+	case reply.Failed:
+		logger.Errorf("error in acknowledging the order %s", err)
+	default:
+		logger.Infof("not acknowledging the order: %s", err)
+	}
+}
+
+func (dicty *DscClient) sendReply(ctx context.Context, msg *gmail.Message, issue *github.Issue, reference, summary string) (string, error) {
+	if reply.Automated(msg) {
+		return reply.Skipped, fmt.Errorf("sent by an automated system or a mailing list")
+	}
+	to, err := reply.Recipient(msg)
+	if err != nil {
+		return reply.Skipped, err
+	}
+	_, done := callUpstream(ctx, metrics.Redis, "count_reply", "reply")
+	ok, err := dicty.Replier.Allow(to.Address)
+	done(err)
+	if err != nil {
+		return reply.Failed, err
+	}
+	if !ok {
+		return reply.RateLimited, fmt.Errorf("%s got the maximum number of replies", to.Address)
+	}
+	data := reply.Data{Reference: reference, Summary: summary}
+	if issue.HTMLURL != nil {
+		data.IssueURL = *issue.HTMLURL
+	}
+	rmsg, err := dicty.Replier.Compose(msg, to, data)
+	if err != nil {
+		return reply.Failed, err
+	}
+	sctx, done := callUpstream(ctx, metrics.Gmail, "messages.send", "reply")
+	_, err = dicty.Gmail.Users.Messages.Send("me", rmsg).Context(sctx).Do()
+	done(err)
+	if err != nil {
+		return reply.Failed, err
+	}
+	return reply.Sent, nil
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats keeps the counters of the notification pipeline reported
+// by the status endpoint, it is safe for concurrent use
+type Stats struct {
+	// accessed atomically, kept first for 64 bit alignment
+	inFlight      int64
+	issuesCreated int64
+	failures      int64
+
+	mu            sync.Mutex
+	lastProcessed time.Time
+}
+
+// StatsSnapshot is a point in time copy of Stats
+type StatsSnapshot struct {
+	QueueDepth    int64     `json:"queue_depth"`
+	IssuesCreated int64     `json:"issues_created"`
+	Failures      int64     `json:"failures"`
+	LastProcessed time.Time `json:"last_processed"`
+}
+
+func NewStats() *Stats {
+	return &Stats{}
+}
+
+// Snapshot returns the current values of the counters
+func (s *Stats) Snapshot() StatsSnapshot {
+	if s == nil {
+		return StatsSnapshot{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StatsSnapshot{
+		QueueDepth:    atomic.LoadInt64(&s.inFlight),
+		IssuesCreated: atomic.LoadInt64(&s.issuesCreated),
+		Failures:      atomic.LoadInt64(&s.failures),
+		LastProcessed: s.lastProcessed,
+	}
+}
+
+func (s *Stats) begin() {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.inFlight, 1)
+}
+
+func (s *Stats) end(err error) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.inFlight, -1)
+	if err != nil {
+		atomic.AddInt64(&s.failures, 1)
+		return
+	}
+	s.mu.Lock()
+	s.lastProcessed = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *Stats) issueCreated() {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.issuesCreated, 1)
+}
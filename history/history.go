@@ -1,33 +1,106 @@
 package history
 
 import (
-	"github.com/garyburd/redigo/redis"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
 )
 
+// DefaultClaimLease is how long the claim of a message keeps other deliveries
+// away, a process that dies while filing the issue leaves its claim behind
+const DefaultClaimLease = 10 * time.Minute
+
+// claimScript claims the message unless it is filed, which is recorded as
+// the number of its issue, or claimed by another delivery within the lease.
+// The claim holds its time in ms and a random token to tell the deliveries
+// apart, a claim without a time is always expired.
+// It returns 0 for a known message, 1 for a new and 2 for an expired claim.
+var claimScript = redis.NewScript(1, `
+local v = redis.call("HGET", KEYS[1], ARGV[1])
+if v then
+	if tonumber(v) then
+		return 0
+	end
+	local claimed = string.match(v, "^pending:(%d+):")
+	if claimed and tonumber(ARGV[3]) - claimed < tonumber(ARGV[4]) then
+		return 0
+	end
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+if v then
+	return 2
+end
+return 1
+`)
+
+var releaseScript = redis.NewScript(1, `
+if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call("HDEL", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// Claim is the pending entry of a message in the ledger
+type Claim struct {
+	value string
+	// Stale tells that the expired claim of an earlier delivery was taken over
+	Stale bool
+}
+
 type HistoryDb struct {
-	redis redis.Conn
+	pool *redis.Pool
 }
 
+// NewHistoryDb creates a pool of redis connections, the
+// connection is checked before it is returned
 func NewHistoryDb(address string) (*HistoryDb, error) {
-	h := &HistoryDb{}
-	c, err := redis.Dial("tcp", address)
-	if err != nil {
+	h := &HistoryDb{
+		pool: &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", address)
+			},
+		},
+	}
+	if _, err := h.Do("PING"); err != nil {
+		h.pool.Close()
 		return h, err
 	}
-	h.redis = c
 	return h, nil
 }
 
+// Close closes the pool and all of its idle connections
+func (h *HistoryDb) Close() error {
+	return h.pool.Close()
+}
+
+// Do runs a single redis command on a connection from the pool, it
+// lets the other redis backed stores share the pool
+func (h *HistoryDb) Do(cmd string, args ...interface{}) (interface{}, error) {
+	conn := h.pool.Get()
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// AddStartHistory records the history id of a new watch, the processing
+// only starts from it when there is no cursor yet. Renewing a watch must not
+// move the cursor past histories that are still unprocessed.
 func (h *HistoryDb) AddStartHistory(id uint64) error {
-	_, err := h.redis.Do("MSET", "start-history", id, "current-history", id)
-	if err != nil {
-		return err
-	}
-	return nil
+	conn := h.pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SET", "start-history", id)
+	conn.Send("SETNX", "current-history", id)
+	_, err := conn.Do("EXEC")
+	return err
 }
 
 func (h *HistoryDb) SetCurrentHistory(id uint64) error {
-	_, err := h.redis.Do("SET", "current-history", id)
+	_, err := h.Do("SET", "current-history", id)
 	if err != nil {
 		return err
 	}
@@ -35,17 +108,110 @@ func (h *HistoryDb) SetCurrentHistory(id uint64) error {
 }
 
 func (h *HistoryDb) HasStartHistory() (bool, error) {
-	return redis.Bool(h.redis.Do("EXISTS", "start-history"))
+	return redis.Bool(h.Do("EXISTS", "start-history"))
 }
 
 func (h *HistoryDb) HasCurrentHistory() (bool, error) {
-	return redis.Bool(h.redis.Do("EXISTS", "current-history"))
+	return redis.Bool(h.Do("EXISTS", "current-history"))
 }
 
 func (h *HistoryDb) GetCurrentHistory() (uint64, error) {
-	return redis.Uint64(h.redis.Do("GET", "current-history"))
+	return redis.Uint64(h.Do("GET", "current-history"))
 }
 
 func (h *HistoryDb) GetStartHistory() (uint64, error) {
-	return redis.Uint64(h.redis.Do("GET", "start-history"))
+	return redis.Uint64(h.Do("GET", "start-history"))
+}
+
+// Ping checks that redis is reachable
+func (h *HistoryDb) Ping() error {
+	_, err := h.Do("PING")
+	return err
+}
+
+// SetWatchExpiration stores the expiration of the gmail watch
+// in milliseconds since epoch as returned by the watch call
+func (h *HistoryDb) SetWatchExpiration(ms int64) error {
+	_, err := h.Do("SET", "watch-expiration", ms)
+	return err
+}
+
+func (h *HistoryDb) HasWatchExpiration() (bool, error) {
+	return redis.Bool(h.Do("EXISTS", "watch-expiration"))
+}
+
+// DeleteWatchExpiration forgets the expiration of a stopped gmail watch
+func (h *HistoryDb) DeleteWatchExpiration() error {
+	_, err := h.Do("DEL", "watch-expiration")
+	return err
+}
+
+// GetWatchExpiration returns the stored expiration of the gmail watch
+func (h *HistoryDb) GetWatchExpiration() (time.Time, error) {
+	ms, err := redis.Int64(h.Do("GET", "watch-expiration"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+// MarkProcessed records in the idempotency ledger that the
+// gmail message has been filed as the github issue
+func (h *HistoryDb) MarkProcessed(msgId string, issue int) error {
+	_, err := h.Do("HSET", "processed-messages", msgId, issue)
+	return err
+}
+
+// IsProcessed tells whether the gmail message is filed, a pending
+// claim does not count
+func (h *HistoryDb) IsProcessed(msgId string) (bool, error) {
+	v, err := redis.String(h.Do("HGET", "processed-messages", msgId))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = strconv.Atoi(v)
+	return err == nil, nil
+}
+
+// ClaimMessage atomically records the gmail message as pending in the
+// ledger. It returns nil when the message is already filed or claimed by
+// another delivery within the lease.
+func (h *HistoryDb) ClaimMessage(msgId string, lease time.Duration) (*Claim, error) {
+	conn := h.pool.Get()
+	defer conn.Close()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	c := &Claim{value: fmt.Sprintf("pending:%d:%x", now, rand.Int63())}
+	n, err := redis.Int(claimScript.Do(
+		conn, "processed-messages", msgId, c.value, now, int64(lease/time.Millisecond),
+	))
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	c.Stale = n == 2
+	return c, nil
+}
+
+// ReleaseMessage removes the claim of a gmail message that could not be
+// filed, a message that already has an issue or got claimed again is left alone
+func (h *HistoryDb) ReleaseMessage(msgId string, c *Claim) error {
+	conn := h.pool.Get()
+	defer conn.Close()
+	_, err := releaseScript.Do(conn, "processed-messages", msgId, c.value)
+	return err
+}
+
+// CountReply adds a reply to the sender and returns the number of replies
+// since the first one of the window, the count expires with the window
+func (h *HistoryDb) CountReply(sender string, window time.Duration) (int64, error) {
+	conn := h.pool.Get()
+	defer conn.Close()
+	key := "reply-count:" + sender
+	// the expiry is only set when the window starts, INCR keeps it
+	if _, err := conn.Do("SET", key, 0, "PX", int64(window/time.Millisecond), "NX"); err != nil {
+		return 0, err
+	}
+	return redis.Int64(conn.Do("INCR", key))
 }
@@ -0,0 +1,154 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newHistoryDb(t *testing.T) *HistoryDb {
+	s := miniredis.RunT(t)
+	h, err := NewHistoryDb(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestLedger(t *testing.T) {
+	h := newHistoryDb(t)
+	known, err := h.IsProcessed("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if known {
+		t.Error("got an unfiled message in the ledger")
+	}
+	if err := h.MarkProcessed("m1", 42); err != nil {
+		t.Fatal(err)
+	}
+	known, err = h.IsProcessed("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !known {
+		t.Error("got a filed message missing from the ledger")
+	}
+}
+
+func TestClaimMessage(t *testing.T) {
+	h := newHistoryDb(t)
+	first, err := h.ClaimMessage("m1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == nil || first.Stale {
+		t.Fatalf("got claim %+v, want a new claim", first)
+	}
+	// a pending claim is not filed but keeps other deliveries away
+	if known, err := h.IsProcessed("m1"); err != nil || known {
+		t.Errorf("got a pending claim as filed %t %v", known, err)
+	}
+	if c, err := h.ClaimMessage("m1", time.Hour); err != nil || c != nil {
+		t.Errorf("got claim %+v %v within the lease, want none", c, err)
+	}
+
+	// the delivery died, the claim is taken over after the lease
+	second, err := h.ClaimMessage("m1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == nil || !second.Stale {
+		t.Fatalf("got claim %+v after the lease, want to take over the expired one", second)
+	}
+	// the late release of the dead delivery leaves the new claim alone
+	if err := h.ReleaseMessage("m1", first); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := h.ClaimMessage("m1", time.Hour); err != nil || c != nil {
+		t.Errorf("got claim %+v %v after releasing the expired claim, want none", c, err)
+	}
+	if err := h.ReleaseMessage("m1", second); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := h.ClaimMessage("m1", time.Hour); err != nil || c == nil || c.Stale {
+		t.Errorf("got claim %+v %v after the release, want a new claim", c, err)
+	}
+
+	// only the issue number means filed, whatever the lease
+	if err := h.MarkProcessed("m1", 42); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := h.ClaimMessage("m1", 0); err != nil || c != nil {
+		t.Errorf("got claim %+v %v for a filed message, want none", c, err)
+	}
+	// a claim without time is left by an older version and always expired
+	if _, err := h.Do("HSET", "processed-messages", "m2", "pending"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := h.ClaimMessage("m2", time.Hour); err != nil || c == nil || !c.Stale {
+		t.Errorf("got claim %+v %v for a claim without time, want to take it over", c, err)
+	}
+}
+
+func TestWatchExpiration(t *testing.T) {
+	h := newHistoryDb(t)
+	if err := h.SetWatchExpiration(1700000000000); err != nil {
+		t.Fatal(err)
+	}
+	exp, err := h.GetWatchExpiration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp.UnixMilli() != 1700000000000 {
+		t.Errorf("got expiration %s", exp)
+	}
+	if err := h.DeleteWatchExpiration(); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := h.HasWatchExpiration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("got a watch expiration after deleting it")
+	}
+}
+
+func TestAddStartHistory(t *testing.T) {
+	h := newHistoryDb(t)
+	if err := h.AddStartHistory(100); err != nil {
+		t.Fatal(err)
+	}
+	// the first watch starts the processing from its history
+	current, err := h.GetCurrentHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != 100 {
+		t.Errorf("got current history %d, want 100", current)
+	}
+	if err := h.SetCurrentHistory(150); err != nil {
+		t.Fatal(err)
+	}
+	// a renewed watch moves the start but keeps the cursor
+	if err := h.AddStartHistory(200); err != nil {
+		t.Fatal(err)
+	}
+	start, err := h.GetStartHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 200 {
+		t.Errorf("got start history %d, want 200", start)
+	}
+	current, err = h.GetCurrentHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != 150 {
+		t.Errorf("got current history %d, want 150", current)
+	}
+}
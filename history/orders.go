@@ -0,0 +1,112 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrOrderNotFound is returned when the index has no order for the id
+var ErrOrderNotFound = errors.New("no order with that id")
+
+// Order is an entry of the order index, it keeps the
+// cross references of the stable order id
+type Order struct {
+	ID        string `json:"id"`
+	MessageID string `json:"message_id"`
+	ThreadID  string `json:"thread_id,omitempty"`
+	// Repository, Issue and IssueURL are empty until the issue is created
+	Repository string    `json:"repository,omitempty"`
+	Issue      int       `json:"issue,omitempty"`
+	IssueURL   string    `json:"issue_url,omitempty"`
+	Created    time.Time `json:"created"`
+}
+
+// FormatOrderID formats the number of the yearly sequence, for example DSC-2026-00123
+func FormatOrderID(prefix string, year int, n int64) string {
+	return fmt.Sprintf("%s-%d-%05d", prefix, year, n)
+}
+
+// OrderID returns the order id of the gmail message. A message without one
+// gets the next number of the sequence of the prefix and year, so a retried
+// message keeps its id.
+func (h *HistoryDb) OrderID(msgId, prefix string, year int) (string, error) {
+	conn := h.pool.Get()
+	defer conn.Close()
+	id, err := redis.String(conn.Do("HGET", "order-ids", msgId))
+	if err == nil {
+		return id, nil
+	}
+	if err != redis.ErrNil {
+		return "", err
+	}
+	n, err := redis.Int64(conn.Do("INCR", fmt.Sprintf("order-sequence:%s:%d", prefix, year)))
+	if err != nil {
+		return "", err
+	}
+	id = FormatOrderID(prefix, year, n)
+	ok, err := redis.Bool(conn.Do("HSETNX", "order-ids", msgId, id))
+	if err != nil {
+		return "", err
+	}
+	// a concurrent call got in first, its id wins
+	if !ok {
+		return redis.String(conn.Do("HGET", "order-ids", msgId))
+	}
+	return id, nil
+}
+
+// SaveOrder adds or replaces the order in the index
+func (h *HistoryDb) SaveOrder(o *Order) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	_, err = h.Do("HSET", "orders", o.ID, b)
+	return err
+}
+
+// GetOrder looks the order up by its id or by the id of its gmail message
+func (h *HistoryDb) GetOrder(id string) (*Order, error) {
+	orderId, err := redis.String(h.Do("HGET", "order-ids", id))
+	switch {
+	case err == redis.ErrNil:
+		orderId = id
+	case err != nil:
+		return nil, err
+	}
+	b, err := redis.Bytes(h.Do("HGET", "orders", orderId))
+	if err == redis.ErrNil {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var o Order
+	if err := json.Unmarshal(b, &o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// ListOrders returns the orders of the index sorted by id
+func (h *HistoryDb) ListOrders() ([]*Order, error) {
+	values, err := redis.ByteSlices(h.Do("HVALS", "orders"))
+	if err != nil {
+		return nil, err
+	}
+	orders := make([]*Order, 0, len(values))
+	for _, b := range values {
+		var o Order
+		if err := json.Unmarshal(b, &o); err != nil {
+			return nil, err
+		}
+		orders = append(orders, &o)
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders, nil
+}
@@ -0,0 +1,99 @@
+package history
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderID(t *testing.T) {
+	h := newHistoryDb(t)
+	cases := []struct {
+		msgId string
+		year  int
+		want  string
+	}{
+		{"m1", 2025, "DSC-2025-00001"},
+		{"m2", 2025, "DSC-2025-00002"},
+		{"m1", 2025, "DSC-2025-00001"},
+		{"m3", 2026, "DSC-2026-00001"},
+		{"m1", 2026, "DSC-2025-00001"},
+		{"m4", 2026, "DSC-2026-00002"},
+	}
+	for _, tc := range cases {
+		id, err := h.OrderID(tc.msgId, "DSC", tc.year)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != tc.want {
+			t.Errorf("got id %s for %s in %d, want %s", id, tc.msgId, tc.year, tc.want)
+		}
+	}
+}
+
+func TestConcurrentOrderID(t *testing.T) {
+	h := newHistoryDb(t)
+	ids := make([]string, 20)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// every message is requested twice
+			id, err := h.OrderID(fmt.Sprintf("m%d", i/2), "DSC", 2026)
+			if err != nil {
+				t.Error(err)
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for i := 0; i < len(ids); i += 2 {
+		if ids[i] != ids[i+1] {
+			t.Errorf("got ids %s and %s for the same message", ids[i], ids[i+1])
+		}
+		if seen[ids[i]] {
+			t.Errorf("got id %s for two messages", ids[i])
+		}
+		seen[ids[i]] = true
+	}
+}
+
+func TestOrders(t *testing.T) {
+	h := newHistoryDb(t)
+	created := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, o := range []*Order{
+		{MessageID: "m1", Issue: 7, Created: created},
+		{MessageID: "m2", Created: created},
+	} {
+		id, err := h.OrderID(o.MessageID, "DSC", 2026)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.ID = id
+		if err := h.SaveOrder(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"DSC-2026-00001", "m1"} {
+		o, err := h.GetOrder(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.ID != "DSC-2026-00001" || o.Issue != 7 || !o.Created.Equal(created) {
+			t.Errorf("got order %+v for %s", o, id)
+		}
+	}
+	if _, err := h.GetOrder("DSC-2026-00009"); err != ErrOrderNotFound {
+		t.Errorf("got error %v, want %v", err, ErrOrderNotFound)
+	}
+	orders, err := h.ListOrders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 || orders[0].ID != "DSC-2026-00001" || orders[1].ID != "DSC-2026-00002" {
+		t.Errorf("got orders %+v, want them sorted by id", orders)
+	}
+}
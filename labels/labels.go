@@ -1,38 +1,294 @@
 package labels
 
 import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
 	"google.golang.org/api/gmail/v1"
 )
 
+// ErrNotFound is returned for a label that is not in the mailbox
+var ErrNotFound = errors.New("label not found")
+
+// missInterval is the minimum time between two refreshes caused by a
+// lookup of an unknown label, so that a typo does not hammer the api
+const missInterval = 10 * time.Second
+
+// Options are the settings of a created label
+type Options struct {
+	// LabelListVisibility is one of labelShow, labelShowIfUnread or labelHide
+	LabelListVisibility string
+	// MessageListVisibility is either show or hide
+	MessageListVisibility string
+	// BackgroundColor and TextColor are hex codes from the gmail palette
+	BackgroundColor string
+	TextColor       string
+}
+
+// LabelManager caches the labels of the mailbox. Lookups are case
+// insensitive and nested labels are looked up by their Parent/Child path.
+// The cache is refreshed once it is older than MaxAge and when a label
+// is not found. It is safe for concurrent use.
 type LabelManager struct {
 	Client *gmail.Service
-	cache  map[string]string
+	// MaxAge is the time after which the cache is refreshed,
+	// zero only refreshes on a miss
+	MaxAge time.Duration
+
+	mu        sync.RWMutex
+	byName    map[string]*gmail.Label
+	byId      map[string]*gmail.Label
+	refreshed time.Time
+	missed    time.Time
 }
 
 func NewLabelManager(client *gmail.Service) *LabelManager {
-	return &LabelManager{client, make(map[string]string)}
+	return &LabelManager{
+		Client: client,
+		byName: make(map[string]*gmail.Label),
+		byId:   make(map[string]*gmail.Label),
+	}
 }
 
+// GenerateCache retrieves all labels of the mailbox
 func (lm *LabelManager) GenerateCache() error {
 	ll, err := lm.Client.Users.Labels.List("me").Do()
 	if err != nil {
 		return err
 	}
+	byName := make(map[string]*gmail.Label, len(ll.Labels))
+	byId := make(map[string]*gmail.Label, len(ll.Labels))
 	for _, l := range ll.Labels {
-		lm.cache[l.Name] = l.Id
+		byName[normalize(l.Name)] = l
+		byId[l.Id] = l
 	}
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.byName = byName
+	lm.byId = byId
+	lm.refreshed = time.Now()
 	return nil
 }
 
+// Labels returns all cached labels
+func (lm *LabelManager) Labels() []*gmail.Label {
+	lm.refreshIfStale()
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	ll := make([]*gmail.Label, 0, len(lm.byId))
+	for _, l := range lm.byId {
+		ll = append(ll, l)
+	}
+	return ll
+}
+
+// Lookup returns the label with the given name or Parent/Child path
+func (lm *LabelManager) Lookup(name string) (*gmail.Label, error) {
+	return lm.lookup(normalize(name), false)
+}
+
+// LookupId returns the label with the given id
+func (lm *LabelManager) LookupId(id string) (*gmail.Label, error) {
+	return lm.lookup(id, true)
+}
+
+func (lm *LabelManager) lookup(key string, byId bool) (*gmail.Label, error) {
+	lm.refreshIfStale()
+	if l, ok := lm.cached(key, byId); ok {
+		return l, nil
+	}
+	lm.mu.Lock()
+	retry := time.Since(lm.missed) >= missInterval
+	if retry {
+		lm.missed = time.Now()
+	}
+	lm.mu.Unlock()
+	if retry {
+		if err := lm.GenerateCache(); err != nil {
+			return nil, err
+		}
+		if l, ok := lm.cached(key, byId); ok {
+			return l, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (lm *LabelManager) cached(key string, byId bool) (*gmail.Label, bool) {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	if byId {
+		l, ok := lm.byId[key]
+		return l, ok
+	}
+	l, ok := lm.byName[key]
+	return l, ok
+}
+
+func (lm *LabelManager) refreshIfStale() {
+	if lm.MaxAge == 0 {
+		return
+	}
+	lm.mu.RLock()
+	stale := time.Since(lm.refreshed) > lm.MaxAge
+	lm.mu.RUnlock()
+	if stale {
+		// a failed refresh keeps serving the stale cache
+		lm.GenerateCache()
+	}
+}
+
 func (lm *LabelManager) HasLabel(name string) bool {
-	_, ok := lm.cache[name]
-	return ok
+	_, err := lm.Lookup(name)
+	return err == nil
 }
 
+// Name2Id returns the id of the label, it is empty for an unknown label
 func (lm *LabelManager) Name2Id(name string) string {
-	_, ok := lm.cache[name]
-	if ok {
-		return lm.cache[name]
+	l, err := lm.Lookup(name)
+	if err != nil {
+		return ""
+	}
+	return l.Id
+}
+
+// Id2Name returns the name of the label, it is empty for an unknown id
+func (lm *LabelManager) Id2Name(id string) string {
+	l, err := lm.LookupId(id)
+	if err != nil {
+		return ""
+	}
+	return l.Name
+}
+
+// EnsureLabel returns the label with the given name or Parent/Child path,
+// it is created together with its missing parents if it does not exist
+func (lm *LabelManager) EnsureLabel(name string, opts Options) (*gmail.Label, error) {
+	l, err := lm.Lookup(name)
+	if err != ErrNotFound {
+		return l, err
+	}
+	parts := splitPath(name)
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+		if lm.HasLabel(parent) {
+			continue
+		}
+		if _, err := lm.create(parent, Options{}); err != nil {
+			return nil, err
+		}
+	}
+	return lm.create(strings.Join(parts, "/"), opts)
+}
+
+func (lm *LabelManager) create(name string, opts Options) (*gmail.Label, error) {
+	label := &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   opts.LabelListVisibility,
+		MessageListVisibility: opts.MessageListVisibility,
+	}
+	if opts.BackgroundColor != "" || opts.TextColor != "" {
+		label.Color = &gmail.LabelColor{
+			BackgroundColor: opts.BackgroundColor,
+			TextColor:       opts.TextColor,
+		}
+	}
+	l, err := lm.Client.Users.Labels.Create("me", label).Do()
+	if err != nil {
+		return nil, err
+	}
+	lm.add(l)
+	return l, nil
+}
+
+// Rename changes the name of the label, a nested label is moved
+// by renaming it to another Parent/Child path. Gmail renames the
+// children of the label as well, so the cache is generated again.
+func (lm *LabelManager) Rename(name, newName string) (*gmail.Label, error) {
+	l, err := lm.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	patch := &gmail.Label{Name: strings.Join(splitPath(newName), "/")}
+	updated, err := lm.Client.Users.Labels.Patch("me", l.Id, patch).Do()
+	if err != nil {
+		return nil, err
+	}
+	if err := lm.GenerateCache(); err != nil {
+		// the children keep their old paths until the next refresh
+		lm.add(updated)
+	}
+	return updated, nil
+}
+
+// Delete removes the label, the messages themselves are kept
+func (lm *LabelManager) Delete(name string) error {
+	l, err := lm.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if err := lm.Client.Users.Labels.Delete("me", l.Id).Do(); err != nil {
+		return err
+	}
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	delete(lm.byName, normalize(l.Name))
+	delete(lm.byId, l.Id)
+	return nil
+}
+
+// batchSize is the maximum number of messages of a batchModify call
+const batchSize = 1000
+
+// Apply adds the label to the messages, or removes it
+func (lm *LabelManager) Apply(name string, ids []string, remove bool) error {
+	l, err := lm.Lookup(name)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		req := &gmail.BatchModifyMessagesRequest{Ids: ids[start:end]}
+		if remove {
+			req.RemoveLabelIds = []string{l.Id}
+		} else {
+			req.AddLabelIds = []string{l.Id}
+		}
+		if err := lm.Client.Users.Messages.BatchModify("me", req).Do(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add puts a label that was created or changed into the cache
+func (lm *LabelManager) add(l *gmail.Label) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if old, ok := lm.byId[l.Id]; ok {
+		delete(lm.byName, normalize(old.Name))
+	}
+	lm.byName[normalize(l.Name)] = l
+	lm.byId[l.Id] = l
+}
+
+// normalize makes the lookup case insensitive and
+// ignores the spaces around the path separators
+func normalize(name string) string {
+	return strings.ToLower(strings.Join(splitPath(name), "/"))
+}
+
+func splitPath(name string) []string {
+	var parts []string
+	for _, p := range strings.Split(name, "/") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
 	}
-	return ""
+	return parts
 }
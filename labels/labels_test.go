@@ -0,0 +1,185 @@
+package labels
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dictybase/gmail-webhook/testing/fake"
+	"google.golang.org/api/gmail/v1"
+)
+
+func newManager(t *testing.T) (*LabelManager, *fake.Gmail) {
+	g := fake.NewGmail()
+	t.Cleanup(g.Close)
+	g.AddLabel("Label_1", "Orders")
+	g.AddLabel("Label_2", "Orders/Stock center")
+	srv, err := gmail.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.BasePath = g.BasePath()
+	lm := NewLabelManager(srv)
+	if err := lm.GenerateCache(); err != nil {
+		t.Fatal(err)
+	}
+	return lm, g
+}
+
+func TestLookup(t *testing.T) {
+	lm, _ := newManager(t)
+	cases := []struct {
+		name string
+		id   string
+	}{
+		{"Orders", "Label_1"},
+		{"orders", "Label_1"},
+		{"Orders/Stock center", "Label_2"},
+		{" orders / STOCK CENTER ", "Label_2"},
+	}
+	for _, c := range cases {
+		if id := lm.Name2Id(c.name); id != c.id {
+			t.Errorf("%q: got id %q, want %q", c.name, id, c.id)
+		}
+	}
+	if name := lm.Id2Name("Label_2"); name != "Orders/Stock center" {
+		t.Errorf("got name %q, want the nested path", name)
+	}
+	if _, err := lm.Lookup("Stock center"); err != ErrNotFound {
+		t.Errorf("got error %v for the child without its parent, want ErrNotFound", err)
+	}
+}
+
+func TestLookupRefresh(t *testing.T) {
+	lm, g := newManager(t)
+	// a miss refreshes the cache
+	g.AddLabel("Label_3", "Invoices")
+	if !lm.HasLabel("Invoices") {
+		t.Fatal("got no label created after the cache was generated")
+	}
+	// the next miss within the interval does not
+	g.AddLabel("Label_4", "Returns")
+	if lm.HasLabel("Returns") {
+		t.Fatal("got a refresh right after the last miss")
+	}
+	// an outdated cache is refreshed regardless
+	lm.MaxAge = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	if !lm.HasLabel("Returns") {
+		t.Error("got no refresh of an outdated cache")
+	}
+}
+
+func TestEnsureLabel(t *testing.T) {
+	lm, _ := newManager(t)
+	l, err := lm.EnsureLabel("Orders/Stock center", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Id != "Label_2" {
+		t.Errorf("got label %s, want the existing Label_2", l.Id)
+	}
+	l, err = lm.EnsureLabel("Archive/2026/Orders", Options{BackgroundColor: "#000000", TextColor: "#ffffff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Name != "Archive/2026/Orders" || l.Color == nil || l.Color.TextColor != "#ffffff" {
+		t.Errorf("got label %+v, want the nested label with its color", l)
+	}
+	for _, parent := range []string{"Archive", "Archive/2026"} {
+		if !lm.HasLabel(parent) {
+			t.Errorf("got no parent label %s", parent)
+		}
+	}
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	lm, g := newManager(t)
+	// every lookup might refresh the cache
+	lm.MaxAge = time.Nanosecond
+	g.AddLabel("Label_3", "Orders/Shipped")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if id := lm.Name2Id("Orders/Stock center"); id != "Label_2" {
+				t.Errorf("got id %q, want Label_2", id)
+			}
+			if id := lm.Name2Id("orders/shipped"); id != "Label_3" {
+				t.Errorf("got id %q, want Label_3", id)
+			}
+			if n := len(lm.Labels()); n != 3 {
+				t.Errorf("got %d labels, want 3", n)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRenameDelete(t *testing.T) {
+	lm, _ := newManager(t)
+	l, err := lm.Rename("orders/stock center", "Orders/Stock Center/Done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Id != "Label_2" || l.Name != "Orders/Stock Center/Done" {
+		t.Errorf("got label %s %q, want the renamed Label_2", l.Id, l.Name)
+	}
+	if id := lm.Name2Id("Orders/Stock center/done"); id != "Label_2" {
+		t.Errorf("got id %q for the new name, want Label_2", id)
+	}
+	if _, err := lm.Rename("Invoices", "Bills"); err != ErrNotFound {
+		t.Errorf("got error %v renaming an unknown label, want ErrNotFound", err)
+	}
+	if err := lm.Delete("Orders/Stock Center/Done"); err != nil {
+		t.Fatal(err)
+	}
+	if id := lm.Id2Name("Label_2"); id != "" {
+		t.Errorf("got name %q for the deleted label", id)
+	}
+}
+
+func TestRenameParent(t *testing.T) {
+	lm, _ := newManager(t)
+	if _, err := lm.Rename("Orders", "Stock orders"); err != nil {
+		t.Fatal(err)
+	}
+	if id := lm.Name2Id("stock orders/stock center"); id != "Label_2" {
+		t.Errorf("got id %q for the moved child, want Label_2", id)
+	}
+	if name := lm.Id2Name("Label_2"); name != "Stock orders/Stock center" {
+		t.Errorf("got name %q, want the path under the renamed parent", name)
+	}
+	if lm.HasLabel("Orders/Stock center") {
+		t.Error("got the child under the old path of its parent")
+	}
+}
+
+func TestApply(t *testing.T) {
+	lm, g := newManager(t)
+	for _, id := range []string{"a", "b"} {
+		g.AddMessage(&gmail.Message{Id: id, ThreadId: id, LabelIds: []string{"INBOX"}})
+	}
+	if err := lm.Apply("Orders", []string{"a", "b"}, false); err != nil {
+		t.Fatal(err)
+	}
+	list, err := lm.Client.Users.Messages.List("me").LabelIds("Label_1").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Messages) != 2 {
+		t.Errorf("got %d labeled messages, want 2", len(list.Messages))
+	}
+	if err := lm.Apply("Orders", []string{"a"}, true); err != nil {
+		t.Fatal(err)
+	}
+	list, err = lm.Client.Users.Messages.List("me").LabelIds("Label_1").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Messages) != 1 || list.Messages[0].Id != "b" {
+		t.Errorf("got %d labeled messages, want only b", len(list.Messages))
+	}
+}
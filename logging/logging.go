@@ -0,0 +1,102 @@
+// Package logging configures the single structured logger shared by the
+// commands, handlers and middlewares. Request scoped fields travel with
+// the context, so that every line about a notification carries them.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Field names shared by all log lines
+const (
+	RequestID       = "request_id"
+	PubsubMessageID = "pubsub_message_id"
+	GmailMessageID  = "gmail_message_id"
+	HistoryID       = "history_id"
+	OrderID         = "order_id"
+)
+
+type contextKey struct{}
+
+// Options configures the logger
+type Options struct {
+	// Level is one of the logrus levels, debug, info, warn or error
+	Level string
+	// Format is either text or json
+	Format string
+	// File is rotated once it reaches MaxSize megabytes, logs
+	// go to stderr if it is empty
+	File       string
+	MaxSize    int
+	MaxBackups int
+	MaxAge     int
+}
+
+var closer io.Closer
+
+// Setup configures the standard logrus logger, the output of the
+// standard library logger is redirected to it as well
+func Setup(opts Options) error {
+	logger := logrus.StandardLogger()
+	level, err := logrus.ParseLevel(opts.Level)
+	if err != nil {
+		return fmt.Errorf("error in parsing log level %s", err)
+	}
+	logger.Level = level
+	switch opts.Format {
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	case "text":
+		logger.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	default:
+		return fmt.Errorf("unknown log format %s, should be either text or json", opts.Format)
+	}
+	logger.Out = os.Stderr
+	if opts.File != "" {
+		lj := &lumberjack.Logger{
+			Filename:   opts.File,
+			MaxSize:    opts.MaxSize,
+			MaxBackups: opts.MaxBackups,
+			MaxAge:     opts.MaxAge,
+		}
+		logger.Out = lj
+		closer = lj
+	}
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer())
+	return nil
+}
+
+// Close flushes and closes the log file, if any
+func Close() error {
+	if closer == nil {
+		return nil
+	}
+	return closer.Close()
+}
+
+// NewContext returns ctx carrying the entry
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// FromContext returns the entry carried by ctx, or an
+// entry of the standard logger if there is none
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(contextKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// WithField returns ctx whose entry carries the additional field
+func WithField(ctx context.Context, key string, value interface{}) context.Context {
+	return NewContext(ctx, FromContext(ctx).WithField(key, value))
+}
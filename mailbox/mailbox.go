@@ -0,0 +1,312 @@
+// Package mailbox is the access layer to the gmail api used by the
+// pipeline. It narrows the history down on the server, fetches every
+// message only once and in the cheapest format that is needed, runs
+// the requests with bounded parallelism and retries rate limited and
+// failed calls with exponential backoff.
+package mailbox
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dictybase/gmail-webhook/failure"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Formats of a retrieved message
+const (
+	// FormatMetadata returns the labels and headers without the body
+	FormatMetadata = "metadata"
+	// FormatFull returns the whole parsed message
+	FormatFull = "full"
+)
+
+// History types that trigger the processing of a message
+const (
+	// MessageAdded is the delivery of a new message
+	MessageAdded = "messageAdded"
+	// LabelAdded is a label added to an existing message, for
+	// example when an email is labeled by hand
+	LabelAdded = "labelAdded"
+)
+
+// ObserveFunc is called before every api call, it returns the context
+// for the call and a function that receives the result of the call
+type ObserveFunc func(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, func(error))
+
+// Client wraps the gmail service of a single mailbox
+type Client struct {
+	Service *gmail.Service
+	// Parallelism bounds the number of concurrent messages.get calls
+	Parallelism int
+	// Retries is the number of retries of a rate limited or failed call
+	Retries int
+	// Backoff is the delay before the first retry, it is doubled
+	// for every following retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Observe instruments the api calls, it is optional
+	Observe ObserveFunc
+}
+
+// New returns a client with the default parallelism and backoff
+func New(srv *gmail.Service) *Client {
+	return &Client{
+		Service:     srv,
+		Parallelism: 8,
+		Retries:     5,
+		Backoff:     500 * time.Millisecond,
+		MaxBackoff:  30 * time.Second,
+	}
+}
+
+// Retryable reports whether a failed gmail call could succeed
+// later, that is a rate limit or a server error
+func Retryable(err error) bool {
+	if failure.GmailRateLimited(err) {
+		return true
+	}
+	gerr, ok := err.(*googleapi.Error)
+	return ok && gerr.Code >= http.StatusInternalServerError
+}
+
+// Retry calls fn until it succeeds or fails with an error that is not
+// retryable. It waits with exponential backoff and jitter in between,
+// and gives up once the retries are exhausted or ctx is done.
+func (c *Client) Retry(ctx context.Context, fn func() error) error {
+	delay := c.Backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.Retries || !Retryable(err) {
+			return err
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+		if delay > c.MaxBackoff {
+			delay = c.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) call(ctx context.Context, operation string, fn func(context.Context) error, attrs ...attribute.KeyValue) error {
+	return c.Retry(ctx, func() error {
+		if c.Observe == nil {
+			return fn(ctx)
+		}
+		cctx, done := c.Observe(ctx, operation, attrs...)
+		err := fn(cctx)
+		done(err)
+		return err
+	})
+}
+
+// History returns all history records after the start id. The records are
+// filtered by gmail on the label and the history types, when given.
+func (c *Client) History(ctx context.Context, start uint64, labelId string, types ...string) ([]*gmail.History, error) {
+	var histList []*gmail.History
+	pageToken := ""
+	for page := 1; ; page++ {
+		call := c.Service.Users.History.List("me").StartHistoryId(start)
+		if labelId != "" {
+			call = call.LabelId(labelId)
+		}
+		if len(types) > 0 {
+			call = call.HistoryTypes(types...)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		var resp *gmail.ListHistoryResponse
+		err := c.call(ctx, "history.list", func(ctx context.Context) error {
+			var err error
+			resp, err = call.Context(ctx).Do()
+			return err
+		},
+			attribute.Int64("gmail.start_history_id", int64(start)),
+			attribute.Int("gmail.page", page),
+		)
+		if err != nil {
+			return histList, err
+		}
+		histList = append(histList, resp.History...)
+		if resp.NextPageToken == "" {
+			return histList, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+// List returns the ids of the messages with the label that match
+// the gmail search query, newest first. Either of them can be empty.
+func (c *Client) List(ctx context.Context, labelId, query string) ([]string, error) {
+	var ids []string
+	pageToken := ""
+	for page := 1; ; page++ {
+		call := c.Service.Users.Messages.List("me")
+		if labelId != "" {
+			call = call.LabelIds(labelId)
+		}
+		if query != "" {
+			call = call.Q(query)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		var resp *gmail.ListMessagesResponse
+		err := c.call(ctx, "messages.list", func(ctx context.Context) error {
+			var err error
+			resp, err = call.Context(ctx).Do()
+			return err
+		}, attribute.Int("gmail.page", page))
+		if err != nil {
+			return ids, err
+		}
+		for _, m := range resp.Messages {
+			ids = append(ids, m.Id)
+		}
+		if resp.NextPageToken == "" {
+			return ids, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+// Message retrieves a single message in the given format
+func (c *Client) Message(ctx context.Context, id, format string) (*gmail.Message, error) {
+	var msg *gmail.Message
+	err := c.call(ctx, "messages.get", func(ctx context.Context) error {
+		var err error
+		msg, err = c.Service.Users.Messages.Get("me", id).Format(format).Context(ctx).Do()
+		return err
+	},
+		attribute.String("gmail.message_id", id),
+		attribute.String("gmail.format", format),
+	)
+	return msg, err
+}
+
+// Messages retrieves the messages concurrently, at most Parallelism at a
+// time, and returns them in the order of the ids. Duplicate ids are only
+// retrieved once. The first error cancels the retrievals in progress, a
+// cancelled context returns its error.
+func (c *Client) Messages(ctx context.Context, ids []string, format string) ([]*gmail.Message, error) {
+	ids = Unique(ids)
+	msgs := make([]*gmail.Message, len(ids))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	n := c.Parallelism
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i, id := range ids {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			msg, err := c.Message(ctx, id, format)
+			if err != nil {
+				once.Do(func() {
+					firstErr = &MessageError{ID: id, Err: err}
+					cancel()
+				})
+				return
+			}
+			msgs[i] = msg
+		}(i, id)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	// the loop stops early once the caller gives up,
+	// leaving messages that were never retrieved
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// MessageError is the failed retrieval of a message
+type MessageError struct {
+	ID  string
+	Err error
+}
+
+func (e *MessageError) Error() string {
+	return "message " + e.ID + ": " + e.Err.Error()
+}
+
+// Unique removes the duplicate ids, keeping the first occurrence
+func Unique(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	var uniq []string
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		uniq = append(uniq, id)
+	}
+	return uniq
+}
+
+// Triggered returns the messages of the history records that changed by
+// one of the given history types, in the order of the records and without
+// duplicates. Added labels only count if the label is among them. The labels
+// of a message are the ones it had when the history was recorded, they might
+// be missing.
+func Triggered(histList []*gmail.History, labelId string, types ...string) []*gmail.Message {
+	seen := make(map[string]bool)
+	var msgs []*gmail.Message
+	add := func(m *gmail.Message) {
+		if m == nil || seen[m.Id] {
+			return
+		}
+		seen[m.Id] = true
+		msgs = append(msgs, m)
+	}
+	added, labeled := has(types, MessageAdded), has(types, LabelAdded)
+	for _, h := range histList {
+		if added {
+			for _, a := range h.MessagesAdded {
+				add(a.Message)
+			}
+		}
+		if labeled {
+			for _, l := range h.LabelsAdded {
+				if labelId == "" || has(l.LabelIds, labelId) {
+					add(l.Message)
+				}
+			}
+		}
+	}
+	return msgs
+}
+
+func has(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
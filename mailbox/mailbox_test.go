@@ -0,0 +1,159 @@
+package mailbox
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dictybase/gmail-webhook/testing/fake"
+	"google.golang.org/api/gmail/v1"
+)
+
+func newClient(t *testing.T, g *fake.Gmail) *Client {
+	srv, err := gmail.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.BasePath = g.BasePath()
+	c := New(srv)
+	c.Backoff = time.Millisecond
+	c.MaxBackoff = 2 * time.Millisecond
+	return c
+}
+
+func TestMessages(t *testing.T) {
+	g := fake.NewGmail()
+	defer g.Close()
+	for _, id := range []string{"a", "b", "c"} {
+		g.AddMessage(&gmail.Message{Id: id, ThreadId: id})
+	}
+	c := newClient(t, g)
+	msgs, err := c.Messages(context.Background(), []string{"c", "a", "c", "b"}, FormatMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range msgs {
+		if m == nil {
+			t.Fatal("got a nil message")
+		}
+		got = append(got, m.Id)
+	}
+	if want := []string{"c", "a", "b"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("got messages %v, want %v", got, want)
+	}
+}
+
+func TestMessagesCancelled(t *testing.T) {
+	g := fake.NewGmail()
+	defer g.Close()
+	g.AddMessage(&gmail.Message{Id: "a", ThreadId: "a"})
+	c := newClient(t, g)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	msgs, err := c.Messages(ctx, []string{"a"}, FormatMetadata)
+	if err == nil {
+		t.Fatalf("got messages %v without an error", msgs)
+	}
+	if msgs != nil {
+		t.Errorf("got messages %v with error %s", msgs, err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	cases := []struct {
+		name     string
+		failures []int
+		retries  int
+		ok       bool
+	}{
+		{"rate limited", []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}, 2, true},
+		{"retries exhausted", []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}, 1, false},
+		{"not retryable", []int{http.StatusNotFound}, 2, false},
+	}
+	for _, c := range cases {
+		g := fake.NewGmail()
+		g.AddMessage(&gmail.Message{Id: "a", ThreadId: "a"})
+		mc := newClient(t, g)
+		mc.Retries = c.retries
+		g.Fail(c.failures...)
+		msg, err := mc.Message(context.Background(), "a", FormatMetadata)
+		if c.ok && (err != nil || msg.Id != "a") {
+			t.Errorf("%s: got error %v, want message a", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: got message without an error", c.name)
+		}
+		g.Close()
+	}
+}
+
+func TestHistory(t *testing.T) {
+	g := fake.NewGmail()
+	defer g.Close()
+	// one history per page, the filters apply across the pages
+	g.PageSize = 1
+	start := g.HistoryID()
+	g.AddMessage(&gmail.Message{Id: "a", ThreadId: "a", LabelIds: []string{"INBOX"}})
+	g.AddMessage(&gmail.Message{Id: "b", ThreadId: "b", LabelIds: []string{"Label_1"}})
+	g.AddMessage(&gmail.Message{Id: "c", ThreadId: "c", LabelIds: []string{"INBOX"}})
+	g.LabelMessage("a", "Label_1")
+	cases := []struct {
+		name    string
+		labelId string
+		types   []string
+		want    []string
+	}{
+		{"unfiltered", "", nil, []string{"a", "b", "c", "a"}},
+		{"label", "Label_1", nil, []string{"b", "a"}},
+		{"added", "Label_1", []string{MessageAdded}, []string{"b"}},
+		{"labeled", "Label_1", []string{LabelAdded}, []string{"a"}},
+	}
+	c := newClient(t, g)
+	for _, tc := range cases {
+		histList, err := c.History(context.Background(), start, tc.labelId, tc.types...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range histList {
+			got = append(got, h.Messages[0].Id)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: got histories of %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTriggered(t *testing.T) {
+	a := &gmail.Message{Id: "a"}
+	b := &gmail.Message{Id: "b"}
+	c := &gmail.Message{Id: "c"}
+	histList := []*gmail.History{
+		{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: a}}},
+		{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: b}, {Message: a}}},
+		{LabelsAdded: []*gmail.HistoryLabelAdded{{Message: c, LabelIds: []string{"Label_1"}}}},
+		{LabelsAdded: []*gmail.HistoryLabelAdded{{Message: a, LabelIds: []string{"Label_1"}}}},
+		{LabelsAdded: []*gmail.HistoryLabelAdded{{Message: b, LabelIds: []string{"STARRED"}}}},
+	}
+	cases := []struct {
+		name  string
+		types []string
+		want  []string
+	}{
+		{"added", []string{MessageAdded}, []string{"a", "b"}},
+		{"labeled", []string{LabelAdded}, []string{"c", "a"}},
+		{"both", []string{MessageAdded, LabelAdded}, []string{"a", "b", "c"}},
+	}
+	for _, tc := range cases {
+		var got []string
+		for _, m := range Triggered(histList, "Label_1", tc.types...) {
+			got = append(got, m.Id)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: got messages %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
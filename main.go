@@ -1,10 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/dictybase/gmail-webhook/commands"
-	"gopkg.in/codegangsta/cli.v1"
+	"github.com/dictybase/gmail-webhook/logging"
+	"gopkg.in/urfave/cli.v1"
 )
 
 func main() {
@@ -12,7 +16,59 @@ func main() {
 	app.Version = "1.0.0"
 	app.Name = "gmail-webhook"
 	app.Usage = "Manage gmail push notifications"
-	app.Commands = []cli.Command{
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "yaml or toml file with the settings of the pipeline(optional), flags and GMAIL_WEBHOOK_ environment variables override it",
+			EnvVar: "GMAIL_WEBHOOK_CONFIG",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Usage: "log level, one of debug, info, warn or error",
+			Value: "info",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "log format, either text or json",
+			Value: "text",
+		},
+		cli.StringFlag{
+			Name:  "log-file, l",
+			Usage: "Name of the log file(optional), default goes to stderr",
+		},
+		cli.IntFlag{
+			Name:  "log-max-size",
+			Usage: "size in megabytes after which the log file is rotated",
+			Value: 100,
+		},
+		cli.IntFlag{
+			Name:  "log-max-backups",
+			Usage: "number of rotated log files to keep, 0 keeps all",
+			Value: 5,
+		},
+		cli.IntFlag{
+			Name:  "log-max-age",
+			Usage: "days to keep rotated log files, 0 keeps them forever",
+			Value: 30,
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if err := commands.ApplyConfig(c); err != nil {
+			return err
+		}
+		return logging.Setup(logging.Options{
+			Level:      c.String("log-level"),
+			Format:     c.String("log-format"),
+			File:       c.String("log-file"),
+			MaxSize:    c.Int("log-max-size"),
+			MaxBackups: c.Int("log-max-backups"),
+			MaxAge:     c.Int("log-max-age"),
+		})
+	}
+	app.After = func(c *cli.Context) error {
+		return logging.Close()
+	}
+	app.Commands = commands.WithConfig([]cli.Command{
 		{
 			Name:   "subscribe",
 			Usage:  "create a new subscription to a topic",
@@ -20,7 +76,7 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "key-file, k",
-					Usage: "key file for authorization(required)",
+					Usage: "service account key file, defaults to GOOGLE_APPLICATION_CREDENTIALS or the application default credentials",
 				},
 				cli.StringFlag{
 					Name:  "project-id, id",
@@ -40,119 +96,563 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "subscription",
+			Usage: "manage the pubsub subscriptions of the project",
+			Flags: []cli.Flag{
+				keyFileFlag,
+				projectFlag,
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the subscriptions",
+					Action: commands.ListSubscriptionsAction,
+				},
+				{
+					Name:      "describe",
+					Usage:     "show the settings of a subscription",
+					ArgsUsage: "<name>",
+					Action:    commands.DescribeSubscriptionAction,
+				},
+				{
+					Name:      "update-endpoint",
+					Usage:     "move a push subscription to a new webhook url",
+					ArgsUsage: "<name> <endpoint>",
+					Action:    commands.UpdateEndpointAction,
+				},
+				{
+					Name:      "delete",
+					Usage:     "delete a subscription",
+					ArgsUsage: "<name>",
+					Action:    commands.DeleteSubscriptionAction,
+				},
+				{
+					Name:      "seek",
+					Usage:     "replay the notifications published since a time",
+					ArgsUsage: "<name>",
+					Action:    commands.SeekSubscriptionAction,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "time",
+							Usage: "replay since this time, as RFC3339",
+						},
+						cli.DurationFlag{
+							Name:  "ago",
+							Usage: "replay since this duration ago",
+						},
+					},
+				},
+			},
+		},
 		{
 			Name:   "authorize",
 			Usage:  "authorize gmail client",
 			Action: commands.AuthGmailAction,
 			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:  "gmail-secret, gs",
-					Usage: "gmail client secret json file",
-				},
-				cli.StringFlag{
-					Name:   "cache-file, cf",
-					Usage:  "location of cached gmail token file, defaults to ~/.credentials/gmail.json",
-					EnvVar: "CACHE_TOKEN_FILE",
-				},
+				gmailSecretFlag,
+				cacheFileFlag,
 			},
 		},
 		{
 			Name:   "watch",
 			Usage:  "setup watch request for subscribed topic",
 			Action: commands.WatchGmailAction,
-			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:  "topic, t",
-					Usage: "Name of the topic",
-				},
-				cli.StringFlag{
-					Name:  "project, p",
-					Usage: "Name of the project",
+			Subcommands: []cli.Command{
+				{
+					Name:   "stop",
+					Usage:  "stop the push notifications of the mailbox",
+					Action: commands.StopWatchAction,
+					Flags:  flags(gmailFlags, redisFlags),
 				},
-				cli.StringFlag{
-					Name:   "cache-file, cf",
-					Usage:  "location of cached gmail token file, defaults to ~/.credentials/gmail.json",
-					EnvVar: "CACHE_TOKEN_FILE",
+				{
+					Name:   "status",
+					Usage:  "show the watch expiration and how far behind the processing is",
+					Action: commands.WatchStatusAction,
+					Flags:  flags(gmailFlags, redisFlags),
 				},
-				cli.StringFlag{
-					Name:  "gmail-secret, gs",
-					Usage: "gmail client secret json file",
-				},
-				cli.StringFlag{
-					Name:  "redis-address",
-					Usage: "IP address of redis-server",
-					Value: "redis",
+			},
+			Flags: flags(
+				[]cli.Flag{
+					cli.StringFlag{
+						Name:  "topic, t",
+						Usage: "Name of the topic",
+					},
+					cli.StringFlag{
+						Name:  "label",
+						Usage: "comma separated gmail labels the notifications are filtered on(optional)",
+					},
+					cli.StringFlag{
+						Name:  "label-filter-action",
+						Usage: "either include to only notify about changes of the labels or exclude to notify about all other changes",
+						Value: "include",
+					},
+					projectFlag,
 				},
-				cli.IntFlag{
-					Name:  "redis-port",
-					Usage: "Port of redis server",
-					Value: 6379,
+				gmailFlags,
+				redisFlags,
+			),
+		},
+		{
+			Name:   "setup",
+			Usage:  "create the pubsub topic, its iam policy and the push subscription, then watch the mailbox",
+			Action: commands.SetupAction,
+			Flags: flags(
+				[]cli.Flag{
+					projectFlag,
+					cli.StringFlag{
+						Name:  "project-number",
+						Usage: "number of the project, grants the pubsub service agent access to the dead-letter topic",
+					},
+					cli.StringFlag{
+						Name:  "topic, t",
+						Usage: "Name of the topic, created if it does not exist",
+					},
+					cli.StringFlag{
+						Name:  "subscription, s",
+						Usage: "Name of the push subscription, created or updated",
+					},
+					cli.StringFlag{
+						Name:  "endpoint, e",
+						Usage: "https url of the webhook, for example https://example.org/gmail/order",
+					},
+					cli.DurationFlag{
+						Name:  "ack-deadline",
+						Usage: "time the webhook has to acknowledge a notification",
+						Value: 10 * time.Second,
+					},
+					cli.StringFlag{
+						Name:  "dead-letter-topic",
+						Usage: "topic for the notifications that failed max-delivery-attempts times(optional)",
+					},
+					cli.IntFlag{
+						Name:  "max-delivery-attempts",
+						Usage: "delivery attempts before a notification is forwarded to the dead-letter topic",
+						Value: 5,
+					},
+					cli.DurationFlag{
+						Name:  "min-backoff",
+						Usage: "minimum delay before a failed notification is redelivered",
+						Value: 10 * time.Second,
+					},
+					cli.DurationFlag{
+						Name:  "max-backoff",
+						Usage: "maximum delay before a failed notification is redelivered",
+						Value: 10 * time.Minute,
+					},
+					cli.StringFlag{
+						Name:  "oidc-service-account",
+						Usage: "service account the push requests are authenticated with an oidc token of(optional)",
+					},
+					cli.StringFlag{
+						Name:  "oidc-audience",
+						Usage: "audience of the oidc token, defaults to the endpoint",
+					},
+					cli.BoolFlag{
+						Name:  "skip-watch",
+						Usage: "do not start the gmail watch",
+					},
+					cli.DurationFlag{
+						Name:  "renew-before",
+						Usage: "start the gmail watch again when the stored one expires within this duration",
+						Value: 24 * time.Hour,
+					},
+					cli.BoolFlag{
+						Name:  "apply",
+						Usage: "make the planned changes, otherwise they are only printed",
+					},
 				},
-			},
+				gmailFlags,
+				redisFlags,
+			),
 		},
 		{
 			Name:   "run",
 			Usage:  "starts the webhook server for gmail push notifications",
 			Action: commands.RunServer,
-			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:  "subscription, s",
-					Usage: "Name of the subscription",
+			Flags: flags(
+				[]cli.Flag{
+					cli.StringFlag{
+						Name:  "subscription, s",
+						Usage: "Name of the subscription",
+					},
+					projectFlag,
+					cli.IntFlag{
+						Name:  "port",
+						Usage: "port on which the server listen",
+						Value: 9998,
+					},
+					cli.StringFlag{
+						Name:  "label",
+						Usage: "Gmail label which will be filtered for messages, nested labels as Parent/Child",
+					},
+					cli.StringFlag{
+						Name:  "mode",
+						Usage: "receive notifications either by push to the webhook endpoint or by pulling from the subscription",
+						Value: "push",
+					},
+					cli.DurationFlag{
+						Name:  "max-age",
+						Usage: "notifications published longer ago than this are reconciled from the stored history instead of trusted, 0 disables the check",
+						Value: time.Hour,
+					},
+					cli.DurationFlag{
+						Name:  "label-max-age",
+						Usage: "refresh the cached gmail labels once they are older than this, 0 only refreshes when a label is not found",
+						Value: time.Hour,
+					},
+					cli.BoolFlag{
+						Name:  "create-label",
+						Usage: "create the label, and its parents, if it does not exist",
+					},
+					cli.StringFlag{
+						Name:  "trigger",
+						Usage: "comma separated gmail history types that create an issue, messageAdded for new emails and labelAdded for emails labeled later",
+						Value: "messageAdded",
+					},
+					cli.IntFlag{
+						Name:  "gmail-parallelism",
+						Usage: "maximum number of gmail messages retrieved at the same time",
+						Value: 8,
+					},
+					cli.IntFlag{
+						Name:  "gmail-retries",
+						Usage: "number of retries with exponential backoff of a rate limited or failed gmail call",
+						Value: 5,
+					},
+					cli.DurationFlag{
+						Name:  "max-extension",
+						Usage: "maximum duration for extending the ack deadline of a message in progress",
+						Value: 10 * time.Minute,
+					},
+					cli.DurationFlag{
+						Name:  "read-timeout",
+						Usage: "maximum duration for reading a request",
+						Value: 10 * time.Second,
+					},
+					cli.DurationFlag{
+						Name:  "write-timeout",
+						Usage: "maximum duration for handling a request and writing its response",
+						Value: 2 * time.Minute,
+					},
+					cli.DurationFlag{
+						Name:  "idle-timeout",
+						Usage: "maximum duration to keep an idle connection open",
+						Value: 2 * time.Minute,
+					},
+					cli.DurationFlag{
+						Name:  "shutdown-timeout",
+						Usage: "maximum duration to wait for in-flight requests or messages on shutdown",
+						Value: 30 * time.Second,
+					},
+					cli.StringFlag{
+						Name:  "trace-exporter",
+						Usage: "exporter for opentelemetry traces, one of none, otlp or stdout",
+						Value: "none",
+					},
+					cli.StringFlag{
+						Name:  "trace-endpoint",
+						Usage: "host:port of the otlp http collector, defaults to the standard OTEL_EXPORTER_OTLP_ENDPOINT",
+					},
+					cli.StringFlag{
+						Name:  "trace-file",
+						Usage: "file for the stdout trace exporter(optional), default goes to stdout",
+					},
+					cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only print the issues that would be created, github and the history cursor are left untouched",
+					},
+					orderPrefixFlag,
+					cli.BoolFlag{
+						Name:  "reply",
+						Usage: "acknowledge every created issue with a reply to the requester on the thread of the order",
+					},
+					cli.StringFlag{
+						Name:  "reply-template",
+						Usage: "go text/template file of the reply(optional), defaults to a built-in template",
+					},
+					cli.BoolFlag{
+						Name:  "reply-issue-url",
+						Usage: "add the url of the github issue to the reply",
+					},
+					cli.IntFlag{
+						Name:  "reply-limit",
+						Usage: "maximum number of replies a sender gets within the reply-window, 0 disables the limit",
+						Value: 5,
+					},
+					cli.DurationFlag{
+						Name:  "reply-window",
+						Usage: "window of the reply-limit",
+						Value: 24 * time.Hour,
+					},
 				},
-				cli.StringFlag{
-					Name:  "project, p",
-					Usage: "Name of the project",
+				gmailFlags,
+				githubFlags,
+				redisFlags,
+				deadLetterFlags,
+			),
+		},
+		{
+			Name:   "backfill",
+			Usage:  "file the orders that arrived under a label before the watch was set up",
+			Action: commands.BackfillAction,
+			Flags: flags(
+				[]cli.Flag{
+					cli.StringFlag{
+						Name:  "label",
+						Usage: "Gmail label of the order emails",
+					},
+					cli.StringFlag{
+						Name:  "since",
+						Usage: "only messages received on or after this date, as YYYY-MM-DD",
+					},
+					cli.StringFlag{
+						Name:  "until",
+						Usage: "only messages received before this date, as YYYY-MM-DD",
+					},
+					cli.StringFlag{
+						Name:  "query, q",
+						Usage: "additional gmail search query for the messages",
+					},
+					cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only print the issues that would be created",
+					},
+					orderPrefixFlag,
 				},
-				cli.StringFlag{
-					Name:   "cache-file, cf",
-					Usage:  "location of cached gmail token file, defaults to ~/.credentials/gmail.json",
-					EnvVar: "CACHE_TOKEN_FILE",
+				gmailFlags,
+				githubFlags,
+				redisFlags,
+			),
+		},
+		{
+			Name:      "preview",
+			Usage:     "print the github issue that would be created for a gmail message",
+			ArgsUsage: "<message-id>",
+			Action:    commands.PreviewAction,
+			Flags: flags(
+				[]cli.Flag{
+					repositoryFlag,
+					ownerFlag,
+					orderPrefixFlag,
 				},
-				cli.StringFlag{
-					Name:  "gmail-secret, gs",
-					Usage: "gmail client secret json file",
+				gmailFlags,
+			),
+		},
+		{
+			Name:  "labels",
+			Usage: "manage the gmail labels the pipeline depends on",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the user labels of the mailbox",
+					Action: commands.ListLabelsAction,
+					Flags: flags(
+						[]cli.Flag{
+							cli.BoolFlag{
+								Name:  "all",
+								Usage: "include the system labels",
+							},
+						},
+						gmailFlags,
+					),
 				},
-				cli.StringFlag{
-					Name:  "gh-token, ght",
-					Usage: "github personal access token file, defaults to ~/.credentials/github.json",
+				{
+					Name:      "create",
+					Usage:     "create a label, nested labels as Parent/Child",
+					ArgsUsage: "<name>",
+					Action:    commands.CreateLabelAction,
+					Flags: flags(
+						[]cli.Flag{
+							cli.StringFlag{
+								Name:  "label-visibility",
+								Usage: "visibility in the label list, one of labelShow, labelShowIfUnread or labelHide",
+							},
+							cli.StringFlag{
+								Name:  "message-visibility",
+								Usage: "visibility in the message list, either show or hide",
+							},
+							cli.StringFlag{
+								Name:  "background-color",
+								Usage: "background color as a hex code of the gmail palette",
+							},
+							cli.StringFlag{
+								Name:  "text-color",
+								Usage: "text color as a hex code of the gmail palette",
+							},
+						},
+						gmailFlags,
+					),
 				},
-				cli.StringFlag{
-					Name:  "log,l",
-					Usage: "Name of the web request log file(optional), default goes to stderr",
+				{
+					Name:      "rename",
+					Usage:     "rename a label",
+					ArgsUsage: "<name> <new-name>",
+					Action:    commands.RenameLabelAction,
+					Flags:     gmailFlags,
 				},
-				cli.StringFlag{
-					Name:  "app-log,apl",
-					Usage: "Name of the application log file(optional), default goes to stderr",
+				{
+					Name:      "delete",
+					Usage:     "delete a label, the messages are kept",
+					ArgsUsage: "<name>",
+					Action:    commands.DeleteLabelAction,
+					Flags:     gmailFlags,
 				},
-				cli.IntFlag{
-					Name:  "port",
-					Usage: "port on which the server listen",
-					Value: 9998,
+				{
+					Name:      "apply",
+					Usage:     "add a label to the messages matching a gmail search query",
+					ArgsUsage: "<name>",
+					Action:    commands.ApplyLabelAction,
+					Flags: flags(
+						[]cli.Flag{
+							cli.StringFlag{
+								Name:  "query, q",
+								Usage: "gmail search query of the messages",
+							},
+							cli.BoolFlag{
+								Name:  "remove",
+								Usage: "remove the label instead of adding it",
+							},
+							cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "only log the number of messages that would change",
+							},
+						},
+						gmailFlags,
+					),
 				},
-				cli.StringFlag{
-					Name:  "label",
-					Usage: "Gmail label which will be filtered for messages",
+			},
+		},
+		{
+			Name:  "filters",
+			Usage: "provision the gmail filters that apply the label to the order emails",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the filters of the mailbox",
+					Action: commands.ListFiltersAction,
+					Flags:  gmailFlags,
 				},
-				cli.StringFlag{
-					Name:  "repository, r",
-					Usage: "Github repository",
+				{
+					Name:   "sync",
+					Usage:  "create the filters declared in the config file that do not exist yet",
+					Action: commands.SyncFiltersAction,
+					Flags: flags(
+						[]cli.Flag{
+							cli.StringFlag{
+								Name:  "label",
+								Usage: "label added by the filters, overrides the one of the config file",
+							},
+							cli.BoolFlag{
+								Name:  "prune",
+								Usage: "delete the filters adding one of the labels that are not declared",
+							},
+							cli.BoolFlag{
+								Name:  "create-label",
+								Usage: "create the labels that do not exist",
+							},
+							cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "only log the filters that would be created or deleted",
+							},
+						},
+						gmailFlags,
+					),
 				},
-				cli.StringFlag{
-					Name:  "owner",
-					Usage: "Github repository owner",
+				{
+					Name:      "delete",
+					Usage:     "delete filters",
+					ArgsUsage: "<filter-id>...",
+					Action:    commands.DeleteFilterAction,
+					Flags:     gmailFlags,
 				},
-				cli.StringFlag{
-					Name:  "redis-address",
-					Usage: "IP address of redis-server",
-					Value: "redis",
+			},
+		},
+		{
+			Name:  "deadletter",
+			Usage: "inspect and replay orders that failed to become github issues",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the failed orders",
+					Action: commands.ListDeadLetterAction,
+					Flags:  flags(deadLetterFlags, redisFlags),
+				},
+				{
+					Name:      "show",
+					Usage:     "show the error and the gmail message of a failed order",
+					ArgsUsage: "<message-id>",
+					Action:    commands.ShowDeadLetterAction,
+					Flags:     flags(deadLetterFlags, redisFlags),
+				},
+				{
+					Name:      "replay",
+					Usage:     "create the github issues of failed orders again",
+					ArgsUsage: "<message-id>...",
+					Action:    commands.ReplayDeadLetterAction,
+					Flags: flags(
+						[]cli.Flag{
+							cli.BoolFlag{
+								Name:  "all",
+								Usage: "replay every failed order",
+							},
+							orderPrefixFlag,
+						},
+						deadLetterFlags,
+						redisFlags,
+						githubFlags,
+						gmailFlags,
+					),
+				},
+			},
+		},
+		{
+			Name:  "orders",
+			Usage: "look up the orders by their order id",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the orders with their github issue",
+					Action: commands.ListOrdersAction,
+					Flags: flags(
+						[]cli.Flag{
+							cli.StringFlag{
+								Name:  "prefix",
+								Usage: "only the order ids that start with this, for example DSC-2026",
+							},
+						},
+						redisFlags,
+					),
+				},
+				{
+					Name:      "show",
+					Usage:     "show the gmail message and github issue of an order",
+					ArgsUsage: "<order-id or message-id>",
+					Action:    commands.ShowOrderAction,
+					Flags:     redisFlags,
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "check the config file",
+			Subcommands: []cli.Command{
+				{
+					Name:   "validate",
+					Usage:  "validate the config file given by the global config option",
+					Action: commands.ValidateConfigAction,
 				},
-				cli.IntFlag{
-					Name:  "redis-port",
-					Usage: "Port of redis server",
-					Value: 6379,
+				{
+					Name:   "print",
+					Usage:  "print the settings of the config file and the environment",
+					Action: commands.PrintConfigAction,
 				},
 			},
 		},
+	})
+	if err := app.Run(os.Args); err != nil {
+		// cli only prints the errors of the actions that are exit coders
+		fmt.Fprintln(os.Stderr, strings.TrimSpace(err.Error()))
+		os.Exit(1)
 	}
-	app.Run(os.Args)
 }
@@ -0,0 +1,146 @@
+// Package metrics defines the prometheus collectors of the notification
+// pipeline. Every collector is labeled with the pipeline, or the http
+// route, so that stalled ingestion can be alerted on.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gmail_webhook"
+
+// Upstream services called by the pipeline
+const (
+	Gmail  = "gmail"
+	Github = "github"
+	Redis  = "redis"
+	None   = "none"
+)
+
+var (
+	NotificationsReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_received_total",
+			Help:      "Gmail notifications received, by pipeline and source (push or pull)",
+		},
+		[]string{"pipeline", "source"},
+	)
+	HistoriesFetched = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "histories_fetched_total",
+			Help:      "Gmail history records fetched",
+		},
+		[]string{"pipeline"},
+	)
+	MessagesMatched = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_matched_total",
+			Help:      "Gmail messages that matched the label",
+		},
+		[]string{"pipeline"},
+	)
+	MessagesSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_skipped_total",
+			Help:      "Gmail messages that did not match the label",
+		},
+		[]string{"pipeline"},
+	)
+	HistoryGaps = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "history_gaps_total",
+			Help:      "Expired gmail history ids the cursor skipped, the orders in between need a backfill",
+		},
+		[]string{"pipeline"},
+	)
+	IssuesCreated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "issues_created_total",
+			Help:      "Github issues created",
+		},
+		[]string{"pipeline"},
+	)
+	Replies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replies_total",
+			Help:      "Acknowledgements to the requesters, by result (sent, rate_limited, skipped or failed)",
+		},
+		[]string{"pipeline", "result"},
+	)
+	Errors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Errors by pipeline stage and the upstream service that caused it",
+		},
+		[]string{"pipeline", "stage", "upstream"},
+	)
+	LastProcessed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_processed_timestamp_seconds",
+			Help:      "Unix time of the last successfully processed notification",
+		},
+		[]string{"pipeline"},
+	)
+	UpstreamLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Latency of the calls to gmail, github and redis",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"upstream", "operation"},
+	)
+	RequestLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of the http requests, by route and status code",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"route", "code"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		NotificationsReceived,
+		HistoriesFetched,
+		MessagesMatched,
+		MessagesSkipped,
+		HistoryGaps,
+		IssuesCreated,
+		Replies,
+		Errors,
+		LastProcessed,
+		UpstreamLatency,
+		RequestLatency,
+	)
+}
+
+// Handler serves the registered metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveUpstream records the latency of an upstream call started at start
+func ObserveUpstream(upstream, operation string, start time.Time) {
+	UpstreamLatency.WithLabelValues(upstream, operation).Observe(time.Since(start).Seconds())
+}
+
+// Error counts an error of the pipeline at the given stage
+func Error(pipeline, stage, upstream string) {
+	Errors.WithLabelValues(pipeline, stage, upstream).Inc()
+}
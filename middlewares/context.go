@@ -0,0 +1,59 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type contextKey int
+
+const (
+	payloadKey contextKey = iota
+	publishTimeKey
+	deliveryAttemptKey
+)
+
+// Middleware wraps a http.Handler
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h with the middlewares, the first
+// middleware is the outermost one to run
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// PayloadFromContext returns the push envelope stored by DecodeMiddleware
+func PayloadFromContext(ctx context.Context) (*GmailPayload, bool) {
+	payload, ok := ctx.Value(payloadKey).(*GmailPayload)
+	return payload, ok
+}
+
+// PublishTimeFromContext returns the publish time of the push message,
+// it is zero when Pub/Sub did not send one
+func PublishTimeFromContext(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(publishTimeKey).(time.Time)
+	return t, ok
+}
+
+// DeliveryAttemptFromContext returns the delivery attempt of the push
+// message, it is zero unless the subscription has a dead-letter policy
+func DeliveryAttemptFromContext(ctx context.Context) (int, bool) {
+	n, ok := ctx.Value(deliveryAttemptKey).(int)
+	return n, ok
+}
+
+// WithDelivery stores the publish time and the delivery attempt of a
+// message, the subscriber uses it for the pulled messages
+func WithDelivery(ctx context.Context, published time.Time, attempt int) context.Context {
+	ctx = context.WithValue(ctx, publishTimeKey, published)
+	return context.WithValue(ctx, deliveryAttemptKey, attempt)
+}
+
+func newPayloadContext(ctx context.Context, payload *GmailPayload, published time.Time) context.Context {
+	ctx = context.WithValue(ctx, payloadKey, payload)
+	return WithDelivery(ctx, published, payload.DeliveryAttempt)
+}
@@ -1,13 +1,15 @@
 package middlewares
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
 	"io"
 	"net/http"
 	"os"
 	"time"
 
-	"github.com/Sirupsen/logrus"
+	"github.com/dictybase/gmail-webhook/logging"
+	"github.com/sirupsen/logrus"
 )
 
 // A custom type that extends http.ResponseWriter interface
@@ -64,7 +66,7 @@ func (rc *realClock) Since(t time.Time) time.Duration {
 type Logger struct {
 	// Logger is the log.Logger instance used to log messages with the Logger middleware
 	Logrus *logrus.Logger
-	// Name is the name of the application as recorded in latency metrics
+	// Name is the name of the application
 	Name string
 
 	logStarting bool
@@ -134,23 +136,34 @@ func (l *Logger) LoggerMiddleware(h http.Handler) http.Handler {
 			"remote":  remoteAddr,
 		})
 
-		if reqID := r.Header.Get("X-Request-Id"); reqID != "" {
-			entry = entry.WithField("request_id", reqID)
+		reqID := r.Header.Get("X-Request-Id")
+		if reqID == "" {
+			reqID = newRequestID()
 		}
+		entry = entry.WithField(logging.RequestID, reqID)
 
 		if l.logStarting {
 			entry.Info("started handling request")
 		}
 		res := &LogResponseWriter{ResponseWriter: w}
-		h.ServeHTTP(res, r)
+		h.ServeHTTP(res, r.WithContext(logging.NewContext(r.Context(), entry)))
 
 		latency := l.clock.Since(start)
 		entry.WithFields(logrus.Fields{
 			"status":      res.Status(),
 			"text_status": http.StatusText(res.Status()),
 			"took":        latency,
-			fmt.Sprintf("measure#%s.latency", l.Name): latency.Nanoseconds(),
 		}).Info("completed handling request")
 	}
 	return http.HandlerFunc(fn)
 }
+
+// newRequestID generates an id for requests that do not carry one,
+// Pub/Sub push requests never set X-Request-Id
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
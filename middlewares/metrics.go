@@ -0,0 +1,29 @@
+package middlewares
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dictybase/gmail-webhook/metrics"
+)
+
+// MetricsMiddleware records the latency and status code
+// of the requests under the given route label
+func MetricsMiddleware(route string) Middleware {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			res := &LogResponseWriter{ResponseWriter: w}
+			h.ServeHTTP(res, r)
+			status := res.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			metrics.RequestLatency.
+				WithLabelValues(route, strconv.Itoa(status)).
+				Observe(time.Since(start).Seconds())
+		}
+		return http.HandlerFunc(fn)
+	}
+}
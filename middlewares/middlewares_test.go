@@ -0,0 +1,133 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const subscription = "projects/dictybase/subscriptions/gmail-order"
+
+func TestStatusCodes(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		code int
+	}{
+		{
+			"valid",
+			`{"subscription":"` + subscription + `","message":{"data":"e30=","message_id":"1","publish_time":"2026-01-02T15:04:05Z"}}`,
+			http.StatusOK,
+		},
+		{
+			"camel case",
+			`{"subscription":"` + subscription + `","message":{"data":"e30=","messageId":"1","publishTime":"2026-01-02T15:04:05.123Z"}}`,
+			http.StatusOK,
+		},
+		{"malformed json", `{"subscription":`, http.StatusAccepted},
+		{
+			"malformed publish time",
+			`{"subscription":"` + subscription + `","message":{"data":"e30=","publish_time":"yesterday"}}`,
+			http.StatusAccepted,
+		},
+		{
+			"other subscription",
+			`{"subscription":"projects/dictybase/subscriptions/other","message":{"data":"e30="}}`,
+			http.StatusAccepted,
+		},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, found := PayloadFromContext(r.Context()); !found {
+			t.Error("expected the payload in the context")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	sub := &GmailSubscription{Name: subscription}
+	h := DecodeMiddleware(sub.ValidateMiddleware(ok))
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/gmail/order", strings.NewReader(c.body))
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s: expected status code %d, got %d", c.name, c.code, w.Code)
+		}
+	}
+}
+
+func TestPubsubMessage(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+	}{
+		{"snake case", `{"message_id":"42","ordering_key":"orders","publish_time":"2026-01-02T15:04:05.5Z"}`},
+		{"camel case", `{"messageId":"42","orderingKey":"orders","publishTime":"2026-01-02T15:04:05.5Z"}`},
+	}
+	want := time.Date(2026, 1, 2, 15, 4, 5, 5e8, time.UTC)
+	for _, c := range cases {
+		var m PubsubMessage
+		if err := json.Unmarshal([]byte(c.body), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.ID() != "42" {
+			t.Errorf("%s: expected id 42, got %q", c.name, m.ID())
+		}
+		if m.Key() != "orders" {
+			t.Errorf("%s: expected ordering key orders, got %q", c.name, m.Key())
+		}
+		published, err := m.Published()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !published.Equal(want) {
+			t.Errorf("%s: expected publish time %s, got %s", c.name, want, published)
+		}
+	}
+	published, err := PubsubMessage{}.Published()
+	if err != nil || !published.IsZero() {
+		t.Errorf("expected a zero publish time without error, got %s %v", published, err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				h.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mw("first"), mw("second"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if got := strings.Join(order, ","); got != "first,second,handler" {
+		t.Errorf("expected first,second,handler, got %s", got)
+	}
+}
+
+func TestContext(t *testing.T) {
+	body := `{"subscription":"` + subscription + `","deliveryAttempt":3,` +
+		`"message":{"data":"e30=","message_id":"1","publish_time":"2026-01-02T15:04:05Z"}}`
+	h := DecodeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if payload, ok := PayloadFromContext(ctx); !ok || payload.Message.ID() != "1" {
+			t.Errorf("expected the payload of message 1, got %v", payload)
+		}
+		want := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+		if published, ok := PublishTimeFromContext(ctx); !ok || !published.Equal(want) {
+			t.Errorf("expected publish time %s, got %s", want, published)
+		}
+		if n, ok := DeliveryAttemptFromContext(ctx); !ok || n != 3 {
+			t.Errorf("expected delivery attempt 3, got %d", n)
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/gmail/order", strings.NewReader(body)))
+	if _, ok := PayloadFromContext(httptest.NewRequest("GET", "/", nil).Context()); ok {
+		t.Error("expected no payload in an empty context")
+	}
+}
@@ -2,30 +2,94 @@ package middlewares
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
+	"time"
 
-	"github.com/cyclopsci/apollo"
-	"golang.org/x/net/context"
+	"github.com/dictybase/gmail-webhook/failure"
+	"github.com/dictybase/gmail-webhook/logging"
+	"github.com/dictybase/gmail-webhook/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// GmailPayload is the envelope of a Pub/Sub push request
 type GmailPayload struct {
-	Message struct {
-		Data      string `json:"data"`
-		MessageID string `json:"message_id"`
-	} `json:"message"`
-	Subscription string `json:"subscription"`
+	Message      PubsubMessage `json:"message"`
+	Subscription string        `json:"subscription"`
+	// DeliveryAttempt is only sent when the subscription
+	// has a dead-letter policy, otherwise it is zero
+	DeliveryAttempt int `json:"deliveryAttempt"`
 }
 
-func DecodeMiddleware(h apollo.Handler) apollo.Handler {
-	fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+// PubsubMessage is the message of a push envelope. Pub/Sub sends some of the
+// fields both in snake and in camel case, the methods return whichever is set.
+type PubsubMessage struct {
+	Attributes       map[string]string `json:"attributes"`
+	Data             string            `json:"data"`
+	MessageID        string            `json:"message_id"`
+	MessageIDCamel   string            `json:"messageId"`
+	PublishTime      string            `json:"publish_time"`
+	PublishTimeCamel string            `json:"publishTime"`
+	OrderingKey      string            `json:"ordering_key"`
+	OrderingKeyCamel string            `json:"orderingKey"`
+}
+
+// ID returns the Pub/Sub message id
+func (m PubsubMessage) ID() string {
+	if m.MessageID != "" {
+		return m.MessageID
+	}
+	return m.MessageIDCamel
+}
+
+// Key returns the ordering key, empty unless message ordering is enabled
+func (m PubsubMessage) Key() string {
+	if m.OrderingKey != "" {
+		return m.OrderingKey
+	}
+	return m.OrderingKeyCamel
+}
+
+// Published returns the time the message was published,
+// it is zero if the envelope has no publish time
+func (m PubsubMessage) Published() (time.Time, error) {
+	pt := m.PublishTime
+	if pt == "" {
+		pt = m.PublishTimeCamel
+	}
+	if pt == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, pt)
+}
+
+func DecodeMiddleware(h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracing.Start(r.Context(), "decode")
 		var payload GmailPayload
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			log.Printf("error in payload decoding %s\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			tracing.End(span, err)
+			logging.FromContext(r.Context()).Errorf("error in payload decoding %s", err)
+			failure.Write(w, failure.NewPermanent(http.StatusBadRequest, err))
+			return
+		}
+		published, err := payload.Message.Published()
+		if err != nil {
+			tracing.End(span, err)
+			logging.FromContext(r.Context()).Errorf("error in parsing publish time %s", err)
+			failure.Write(w, failure.NewPermanent(http.StatusBadRequest, err))
 			return
 		}
-		h.ServeHTTP(context.WithValue(ctx, "payload", &payload), w, r)
+		span.SetAttributes(
+			attribute.String("messaging.message.id", payload.Message.ID()),
+			attribute.Int("messaging.gcp_pubsub.message.delivery_attempt", payload.DeliveryAttempt),
+		)
+		tracing.End(span, nil)
+		ctx := logging.WithField(r.Context(), logging.PubsubMessageID, payload.Message.ID())
+		logging.FromContext(ctx).
+			WithField("delivery_attempt", payload.DeliveryAttempt).
+			Infof("received message published at %s", published.Format(time.RFC3339))
+		ctx = newPayloadContext(ctx, &payload, published)
+		h.ServeHTTP(w, r.WithContext(ctx))
 	}
-	return apollo.HandlerFunc(fn)
+	return http.HandlerFunc(fn)
 }
@@ -0,0 +1,32 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/dictybase/gmail-webhook/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// TracingMiddleware starts a server span for the route, continuing the
+// trace of the incoming request if it carries one
+func TracingMiddleware(route string) Middleware {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracing.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracing.Start(
+				ctx,
+				r.Method+" "+route,
+				attribute.String("http.route", route),
+				attribute.String("http.request.method", r.Method),
+			)
+			defer span.End()
+			res := &LogResponseWriter{ResponseWriter: w}
+			h.ServeHTTP(res, r.WithContext(ctx))
+			if res.Status() != 0 {
+				span.SetAttributes(attribute.Int("http.response.status_code", res.Status()))
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
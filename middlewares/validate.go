@@ -1,36 +1,47 @@
 package middlewares
 
 import (
-	"fmt"
-	"log"
 	"net/http"
 
-	"github.com/cyclopsci/apollo"
-	"golang.org/x/net/context"
+	"github.com/dictybase/gmail-webhook/failure"
+	"github.com/dictybase/gmail-webhook/logging"
+	"github.com/dictybase/gmail-webhook/tracing"
 )
 
 type GmailSubscription struct {
 	Name string
 }
 
-func (s *GmailSubscription) ValidateMiddleware(h apollo.Handler) apollo.Handler {
-	fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-		payload, ok := ctx.Value("payload").(*GmailPayload)
+func (s *GmailSubscription) ValidateMiddleware(h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracing.Start(r.Context(), "validate")
+		payload, ok := PayloadFromContext(r.Context())
 		if !ok {
-			log.Println("error in retrieving payload from *payload*")
-			http.Error(w, "unable to retrieve payload from *payload*", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("error in retrieving payload from context")
+			err := failure.Transientf(
+				http.StatusInternalServerError,
+				"unable to retrieve payload from context",
+			)
+			tracing.End(span, err)
+			failure.Write(w, err)
 			return
 		}
 		if s.Name != payload.Subscription {
-			log.Printf("Expected subscription %s does not match with existing subscription %s\n", s.Name, payload.Subscription)
-			http.Error(
-				w,
-				fmt.Sprintf("Expected subscription %s does not match with existing subscription %s\n", s.Name, payload.Subscription),
-				http.StatusInternalServerError,
+			logging.FromContext(r.Context()).Errorf(
+				"Expected subscription %s does not match with existing subscription %s",
+				s.Name, payload.Subscription,
+			)
+			err := failure.Permanentf(
+				http.StatusForbidden,
+				"Expected subscription %s does not match with existing subscription %s\n",
+				s.Name, payload.Subscription,
 			)
+			tracing.End(span, err)
+			failure.Write(w, err)
 			return
 		}
-		h.ServeHTTP(ctx, w, r)
+		tracing.End(span, nil)
+		h.ServeHTTP(w, r)
 	}
-	return apollo.HandlerFunc(fn)
+	return http.HandlerFunc(fn)
 }
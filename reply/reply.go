@@ -0,0 +1,236 @@
+// Package reply acknowledges an order to the person who placed it. The
+// reply is rendered from a template, sent on the thread of the order
+// email and limited to a number of replies per sender within a window.
+package reply
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Results of an acknowledgement, they label the replies metric
+const (
+	Sent        = "sent"
+	RateLimited = "rate_limited"
+	// Skipped are orders without a sender to reply to or
+	// sent by an automated system
+	Skipped = "skipped"
+	Failed  = "failed"
+)
+
+// DefaultTemplate is used when no template file is given
+const DefaultTemplate = `Dear {{.Name}},
+
+thank you for your order, we have received it under the reference {{.Reference}}.
+{{- if .IssueURL}}
+You can follow its progress at {{.IssueURL}}
+{{- end}}
+
+{{quote .Summary}}
+
+This is an automated reply, please answer on this thread for any question about the order.
+`
+
+// Data is passed to the template
+type Data struct {
+	// Name is the display name of the sender, or its address without one
+	Name    string
+	Address string
+	Subject string
+	// Summary is the order as filed in the issue
+	Summary string
+	// Reference is the order id, or the issue number without order ids
+	Reference string
+	// IssueURL is empty unless the issue url is enabled
+	IssueURL string
+}
+
+var funcs = template.FuncMap{
+	// quote prefixes every line with >
+	"quote": func(s string) string {
+		lines := strings.Split(strings.TrimRight(s, "\r\n"), "\n")
+		for i, l := range lines {
+			lines[i] = strings.TrimRight("> "+strings.TrimRight(l, "\r"), " ")
+		}
+		return strings.Join(lines, "\n")
+	},
+}
+
+// ParseTemplate reads the template file, the default
+// template is used when the file is empty
+func ParseTemplate(file string) (*template.Template, error) {
+	if file == "" {
+		return template.New("reply").Funcs(funcs).Parse(DefaultTemplate)
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error in reading reply template %s", err)
+	}
+	t, err := template.New(file).Funcs(funcs).Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("error in parsing reply template %s %s", file, err)
+	}
+	return t, nil
+}
+
+// Counter counts the replies to a sender
+type Counter interface {
+	// CountReply adds a reply to the sender and returns the number
+	// of replies since the window of the first one started
+	CountReply(sender string, window time.Duration) (int64, error)
+}
+
+// Replier composes the acknowledgements
+type Replier struct {
+	Template *template.Template
+	// IssueURL adds the url of the github issue to the reply
+	IssueURL bool
+	// Limit is the number of replies a sender gets within
+	// Window, zero means no limit
+	Limit   int
+	Window  time.Duration
+	Counter Counter
+}
+
+// Allow counts a reply to the sender and reports whether it is within the limit
+func (r *Replier) Allow(sender string) (bool, error) {
+	if r.Limit <= 0 || r.Counter == nil {
+		return true, nil
+	}
+	n, err := r.Counter.CountReply(strings.ToLower(sender), r.Window)
+	if err != nil {
+		return false, err
+	}
+	return n <= int64(r.Limit), nil
+}
+
+// Compose renders the reply to the order email on its thread
+func (r *Replier) Compose(msg *gmail.Message, to *mail.Address, data Data) (*gmail.Message, error) {
+	data.Address = to.Address
+	data.Name = to.Name
+	if data.Name == "" {
+		data.Name = to.Address
+	}
+	if data.Subject == "" {
+		data.Subject = Header(msg, "Subject")
+	}
+	if !r.IssueURL {
+		data.IssueURL = ""
+	}
+	var text bytes.Buffer
+	if err := r.Template.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("error in rendering reply %s", err)
+	}
+
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "To: %s\r\n", to.String())
+	fmt.Fprintf(&raw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", replySubject(data.Subject)))
+	if id := Header(msg, "Message-ID"); id != "" {
+		fmt.Fprintf(&raw, "In-Reply-To: %s\r\n", id)
+		fmt.Fprintf(&raw, "References: %s\r\n", strings.TrimSpace(Header(msg, "References")+" "+id))
+	}
+	raw.WriteString("Auto-Submitted: auto-replied\r\n")
+	raw.WriteString("MIME-Version: 1.0\r\n")
+	raw.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
+	raw.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&raw)
+	if _, err := qp.Write(text.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return &gmail.Message{
+		Raw:      base64.URLEncoding.EncodeToString(raw.Bytes()),
+		ThreadId: msg.ThreadId,
+	}, nil
+}
+
+// Recipient is the address the reply goes to, the
+// Reply-To header wins over the sender
+func Recipient(msg *gmail.Message) (*mail.Address, error) {
+	from := Header(msg, "Reply-To")
+	if from == "" {
+		from = Header(msg, "From")
+	}
+	if from == "" {
+		return nil, fmt.Errorf("message %s has no sender", msg.Id)
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("error in parsing sender %q %s", from, err)
+	}
+	return addr, nil
+}
+
+// noReplyPrefixes start the local parts of the addresses that do not
+// take replies, such as noreply-orders@example.org
+var noReplyPrefixes = []string{
+	"noreply", "no-reply", "no_reply", "donotreply", "do-not-reply",
+	"do_not_reply", "mailer-daemon", "postmaster",
+}
+
+// Automated tells whether the email was sent by an automated system or
+// a mailing list, or from an address that does not take replies. Those
+// are never answered to avoid mail loops.
+func Automated(msg *gmail.Message) bool {
+	if v := Header(msg, "Auto-Submitted"); v != "" && !strings.EqualFold(v, "no") {
+		return true
+	}
+	switch strings.ToLower(Header(msg, "Precedence")) {
+	case "bulk", "junk", "list":
+		return true
+	}
+	if Header(msg, "List-Id") != "" || Header(msg, "List-Unsubscribe") != "" {
+		return true
+	}
+	return noReply(Header(msg, "From")) || noReply(Header(msg, "Reply-To"))
+}
+
+func noReply(header string) bool {
+	addr, err := mail.ParseAddress(header)
+	if err != nil {
+		return false
+	}
+	local := strings.ToLower(addr.Address)
+	if i := strings.LastIndex(local, "@"); i >= 0 {
+		local = local[:i]
+	}
+	for _, p := range noReplyPrefixes {
+		if strings.HasPrefix(local, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Header returns the value of the first header with the name,
+// header names are compared case insensitively
+func Header(msg *gmail.Message, name string) string {
+	if msg.Payload == nil {
+		return ""
+	}
+	for _, h := range msg.Payload.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func replySubject(s string) string {
+	if strings.HasPrefix(strings.ToLower(s), "re:") {
+		return s
+	}
+	return "Re: " + s
+}
@@ -0,0 +1,202 @@
+package reply
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func newMessage(headers ...string) *gmail.Message {
+	msg := &gmail.Message{Id: "m1", ThreadId: "t1", Payload: &gmail.MessagePart{}}
+	for i := 0; i+1 < len(headers); i += 2 {
+		msg.Payload.Headers = append(msg.Payload.Headers, &gmail.MessagePartHeader{Name: headers[i], Value: headers[i+1]})
+	}
+	return msg
+}
+
+// decode parses the raw reply into its headers and
+// plain text with unix line endings
+func decode(t *testing.T, msg *gmail.Message) (mail.Header, string) {
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(m.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Header, strings.Replace(string(body), "\r\n", "\n", -1)
+}
+
+func TestCompose(t *testing.T) {
+	tmpl, err := ParseTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := newMessage(
+		"From", "Jane Doe <jane@example.org>",
+		"Subject", "Strain order",
+		"Message-ID", "<order@example.org>",
+		"References", "<earlier@example.org>",
+	)
+	data := Data{
+		Summary:   "DBS0236726\nDBS0351079",
+		Reference: "42",
+		IssueURL:  "https://github.com/dictybase/orders/issues/42",
+	}
+	cases := []struct {
+		name     string
+		issueURL bool
+		to       *mail.Address
+		contains []string
+		excludes []string
+	}{
+		{
+			"with issue url", true, &mail.Address{Name: "Jane Doe", Address: "jane@example.org"},
+			[]string{"Dear Jane Doe,", "reference 42", "at https://github.com/dictybase/orders/issues/42", "> DBS0236726\n> DBS0351079"},
+			nil,
+		},
+		{
+			"without issue url", false, &mail.Address{Name: "Jane Doe", Address: "jane@example.org"},
+			[]string{"reference 42"},
+			[]string{"github.com"},
+		},
+		{
+			"without display name", false, &mail.Address{Address: "jane@example.org"},
+			[]string{"Dear jane@example.org,"},
+			nil,
+		},
+	}
+	for _, tc := range cases {
+		r := &Replier{Template: tmpl, IssueURL: tc.issueURL}
+		msg, err := r.Compose(order, tc.to, data)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if msg.ThreadId != "t1" {
+			t.Errorf("%s: got thread %q, want the thread of the order", tc.name, msg.ThreadId)
+		}
+		header, body := decode(t, msg)
+		for key, want := range map[string]string{
+			"Subject":        "Re: Strain order",
+			"In-Reply-To":    "<order@example.org>",
+			"References":     "<earlier@example.org> <order@example.org>",
+			"Auto-Submitted": "auto-replied",
+		} {
+			if got := header.Get(key); got != want {
+				t.Errorf("%s: got %s %q, want %q", tc.name, key, got, want)
+			}
+		}
+		for _, s := range tc.contains {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: reply %q misses %q", tc.name, body, s)
+			}
+		}
+		for _, s := range tc.excludes {
+			if strings.Contains(body, s) {
+				t.Errorf("%s: reply %q contains %q", tc.name, body, s)
+			}
+		}
+	}
+}
+
+type counter map[string]int64
+
+func (c counter) CountReply(sender string, window time.Duration) (int64, error) {
+	c[sender]++
+	return c[sender], nil
+}
+
+func TestAllow(t *testing.T) {
+	cases := []struct {
+		name    string
+		limit   int
+		senders []string
+		want    []bool
+	}{
+		{"unlimited", 0, []string{"a@x.org", "a@x.org", "a@x.org"}, []bool{true, true, true}},
+		{"limited", 2, []string{"a@x.org", "a@x.org", "a@x.org"}, []bool{true, true, false}},
+		{"per sender", 1, []string{"a@x.org", "b@x.org", "a@x.org"}, []bool{true, true, false}},
+		{"case insensitive", 1, []string{"a@x.org", "A@X.org"}, []bool{true, false}},
+	}
+	for _, tc := range cases {
+		r := &Replier{Limit: tc.limit, Window: time.Hour, Counter: counter{}}
+		for i, s := range tc.senders {
+			ok, err := r.Allow(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.want[i] {
+				t.Errorf("%s: reply %d to %s got %t, want %t", tc.name, i, s, ok, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestAutomated(t *testing.T) {
+	cases := []struct {
+		name    string
+		headers []string
+		want    bool
+	}{
+		{"person", []string{"From", "jane@example.org"}, false},
+		{"auto replied", []string{"Auto-Submitted", "auto-replied"}, true},
+		{"auto generated", []string{"auto-submitted", "auto-generated"}, true},
+		{"not auto submitted", []string{"Auto-Submitted", "no"}, false},
+		{"bulk", []string{"Precedence", "bulk"}, true},
+		{"mailing list", []string{"Precedence", "list"}, true},
+		{"junk", []string{"Precedence", "Junk"}, true},
+		{"list id", []string{"List-Id", "Orders <orders.lists.example.org>"}, true},
+		{"list unsubscribe", []string{"List-Unsubscribe", "<mailto:leave@example.org>"}, true},
+		{"no reply", []string{"From", "Stock Center <noreply@example.org>"}, true},
+		{"no reply with suffix", []string{"From", "No-Reply-Orders@example.org"}, true},
+		{"do not reply", []string{"From", "do-not-reply@example.org"}, true},
+		{"bounce", []string{"From", "MAILER-DAEMON@example.org"}, true},
+		{"no reply to", []string{"From", "jane@example.org", "Reply-To", "noreply@example.org"}, true},
+		{"person named like no reply", []string{"From", "Noreen Reply <noreen@example.org>"}, false},
+		{"unparsable sender", []string{"From", "not an address"}, false},
+	}
+	for _, tc := range cases {
+		if got := Automated(newMessage(tc.headers...)); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRecipient(t *testing.T) {
+	cases := []struct {
+		name    string
+		headers []string
+		want    string
+	}{
+		{"sender", []string{"From", "Jane Doe <jane@example.org>"}, "jane@example.org"},
+		{"reply to", []string{"From", "jane@example.org", "Reply-To", "lab@example.org"}, "lab@example.org"},
+		{"without sender", nil, ""},
+	}
+	for _, tc := range cases {
+		addr, err := Recipient(newMessage(tc.headers...))
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+			continue
+		}
+		if addr.Address != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, addr.Address, tc.want)
+		}
+	}
+}
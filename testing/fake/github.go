@@ -0,0 +1,101 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/github"
+)
+
+// Github fakes the issues api of github
+type Github struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	number int
+	issues map[string][]*github.Issue
+}
+
+// NewGithub starts a fake github server, it should be closed by the caller
+func NewGithub() *Github {
+	gh := &Github{issues: make(map[string][]*github.Issue)}
+	gh.Server = httptest.NewServer(http.HandlerFunc(gh.serve))
+	return gh
+}
+
+// BaseURL is the value for the BaseURL of a github.Client
+func (gh *Github) BaseURL() string {
+	return gh.URL + "/"
+}
+
+// Issues returns the issues created in the repository
+func (gh *Github) Issues(owner, repo string) []*github.Issue {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	return append([]*github.Issue{}, gh.issues[owner+"/"+repo]...)
+}
+
+func (gh *Github) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/rate_limit" {
+		writeJSON(w, map[string]interface{}{
+			"resources": map[string]interface{}{
+				"core": map[string]int{"limit": 5000, "remaining": 5000},
+			},
+		})
+		return
+	}
+	// expects /repos/:owner/:repo/issues
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "repos" || parts[3] != "issues" {
+		githubError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	key := parts[1] + "/" + parts[2]
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	switch r.Method {
+	case "GET":
+		writeJSON(w, gh.issues[key])
+	case "POST":
+		var req github.IssueRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			githubError(w, http.StatusBadRequest, "Problems parsing JSON")
+			return
+		}
+		if req.Title == nil || *req.Title == "" {
+			githubError(w, http.StatusUnprocessableEntity, "Validation Failed")
+			return
+		}
+		gh.number++
+		number := gh.number
+		url := fmt.Sprintf("https://github.com/%s/issues/%d", key, number)
+		issue := &github.Issue{
+			Number:  &number,
+			Title:   req.Title,
+			Body:    req.Body,
+			HTMLURL: &url,
+		}
+		if req.Labels != nil {
+			for _, name := range *req.Labels {
+				n := name
+				issue.Labels = append(issue.Labels, github.Label{Name: &n})
+			}
+		}
+		gh.issues[key] = append(gh.issues[key], issue)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(issue)
+	default:
+		githubError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+func githubError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"message":%q}`, msg)
+}
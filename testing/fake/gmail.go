@@ -0,0 +1,414 @@
+// Package fake provides in-process http fakes of the gmail and github
+// apis used by the webhook. The production clients can be pointed at them
+// with the gmail-endpoint and github-endpoint flags, which makes it possible
+// to exercise the whole pipeline without any network access.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const gmailPrefix = "/gmail/v1/users/me/"
+
+// Gmail fakes the history, messages, labels and
+// watch endpoints of a single mailbox
+type Gmail struct {
+	*httptest.Server
+	// PageSize is the number of history records returned in a page
+	PageSize int
+
+	mu        sync.Mutex
+	historyId uint64
+	// expired is the history id before which the histories are gone
+	expired   uint64
+	labels    []*gmail.Label
+	messages  map[string]*gmail.Message
+	histories []*gmail.History
+	watches   []*gmail.WatchRequest
+	filters   []*gmail.Filter
+	sent      []*gmail.Message
+	failures  []int
+}
+
+// NewGmail starts a fake gmail server, it should be closed by the caller
+func NewGmail() *Gmail {
+	g := &Gmail{
+		PageSize:  100,
+		historyId: 1000,
+		messages:  make(map[string]*gmail.Message),
+	}
+	g.Server = httptest.NewServer(http.HandlerFunc(g.serve))
+	return g
+}
+
+// BasePath is the value for the BasePath of a gmail.Service
+func (g *Gmail) BasePath() string {
+	return g.URL + "/"
+}
+
+// AddLabel adds a user label to the mailbox
+func (g *Gmail) AddLabel(id, name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.labels = append(g.labels, &gmail.Label{Id: id, Name: name, Type: "user"})
+}
+
+// AddMessage stores the message and records a messagesAdded history for it.
+// It returns the new history id of the mailbox.
+func (g *Gmail) AddMessage(msg *gmail.Message) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.historyId++
+	msg.HistoryId = g.historyId
+	g.messages[msg.Id] = msg
+	ref := &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId, LabelIds: append([]string{}, msg.LabelIds...)}
+	g.histories = append(g.histories, &gmail.History{
+		Id:            g.historyId,
+		Messages:      []*gmail.Message{ref},
+		MessagesAdded: []*gmail.HistoryMessageAdded{{Message: ref}},
+	})
+	return g.historyId
+}
+
+// LabelMessage adds the label to a stored message and records a
+// labelsAdded history for it. It returns the new history id of the mailbox.
+func (g *Gmail) LabelMessage(id, labelId string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	msg, ok := g.messages[id]
+	if !ok {
+		return g.historyId
+	}
+	g.historyId++
+	msg.HistoryId = g.historyId
+	msg.LabelIds = append(msg.LabelIds, labelId)
+	ref := &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId, LabelIds: append([]string{}, msg.LabelIds...)}
+	g.histories = append(g.histories, &gmail.History{
+		Id:       g.historyId,
+		Messages: []*gmail.Message{ref},
+		LabelsAdded: []*gmail.HistoryLabelAdded{
+			{Message: ref, LabelIds: []string{labelId}},
+		},
+	})
+	return g.historyId
+}
+
+// Fail makes the following requests fail with the given status
+// codes, one code per request, for example to exercise the backoff
+func (g *Gmail) Fail(codes ...int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.failures = append(g.failures, codes...)
+}
+
+// ExpireHistory drops the histories recorded so far, as gmail does after
+// about a week. Listing the histories from an earlier id fails with a 404.
+func (g *Gmail) ExpireHistory() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expired = g.historyId
+}
+
+// HistoryID returns the current history id of the mailbox
+func (g *Gmail) HistoryID() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.historyId
+}
+
+// Watches returns all watch requests received so far
+func (g *Gmail) Watches() []*gmail.WatchRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*gmail.WatchRequest{}, g.watches...)
+}
+
+// Sent returns all messages sent so far
+func (g *Gmail) Sent() []*gmail.Message {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*gmail.Message{}, g.sent...)
+}
+
+func (g *Gmail) serve(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, gmailPrefix) {
+		writeError(w, http.StatusNotFound, "unknown path "+r.URL.Path)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.failures) > 0 {
+		code := g.failures[0]
+		g.failures = g.failures[1:]
+		writeError(w, code, http.StatusText(code))
+		return
+	}
+	route := strings.TrimPrefix(r.URL.Path, gmailPrefix)
+	switch {
+	case route == "history" && r.Method == "GET":
+		g.listHistory(w, r)
+	case route == "profile" && r.Method == "GET":
+		writeJSON(w, &gmail.Profile{EmailAddress: "orders@dictybase.org", HistoryId: g.historyId})
+	case route == "labels" && r.Method == "GET":
+		writeJSON(w, &gmail.ListLabelsResponse{Labels: g.labels})
+	case route == "labels" && r.Method == "POST":
+		g.createLabel(w, r)
+	case route == "watch" && r.Method == "POST":
+		g.watch(w, r)
+	case strings.HasPrefix(route, "labels/") && r.Method == "PATCH":
+		g.patchLabel(w, r, strings.TrimPrefix(route, "labels/"))
+	case strings.HasPrefix(route, "labels/") && r.Method == "DELETE":
+		g.deleteLabel(w, strings.TrimPrefix(route, "labels/"))
+	case route == "settings/filters" && r.Method == "GET":
+		writeJSON(w, &gmail.ListFiltersResponse{Filter: g.filters})
+	case route == "settings/filters" && r.Method == "POST":
+		g.createFilter(w, r)
+	case strings.HasPrefix(route, "settings/filters/") && r.Method == "DELETE":
+		g.deleteFilter(w, strings.TrimPrefix(route, "settings/filters/"))
+	case route == "messages" && r.Method == "GET":
+		g.listMessages(w, r)
+	case route == "messages/batchModify" && r.Method == "POST":
+		g.batchModify(w, r)
+	case route == "messages/send" && r.Method == "POST":
+		g.send(w, r)
+	case strings.HasPrefix(route, "messages/") && r.Method == "GET":
+		msg, ok := g.messages[strings.TrimPrefix(route, "messages/")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Requested entity was not found.")
+			return
+		}
+		writeJSON(w, withFormat(msg, r.URL.Query().Get("format")))
+	default:
+		writeError(w, http.StatusNotFound, "unknown path "+r.URL.Path)
+	}
+}
+
+func (g *Gmail) listHistory(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseUint(r.URL.Query().Get("startHistoryId"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid startHistoryId")
+		return
+	}
+	if start < g.expired {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	labelId := r.URL.Query().Get("labelId")
+	types := r.URL.Query()["historyTypes"]
+	var matched []*gmail.History
+	for _, h := range g.histories {
+		if h.Id <= start {
+			continue
+		}
+		if labelId != "" && !contains(h.Messages[0].LabelIds, labelId) {
+			continue
+		}
+		if len(types) > 0 && !hasType(h, types) {
+			continue
+		}
+		matched = append(matched, h)
+	}
+	offset := 0
+	if token := r.URL.Query().Get("pageToken"); token != "" {
+		offset, err = strconv.Atoi(token)
+		if err != nil || offset > len(matched) {
+			writeError(w, http.StatusBadRequest, "Invalid pageToken")
+			return
+		}
+	}
+	resp := &gmail.ListHistoryResponse{HistoryId: g.historyId}
+	end := offset + g.PageSize
+	if end < len(matched) {
+		resp.NextPageToken = strconv.Itoa(end)
+	} else {
+		end = len(matched)
+	}
+	resp.History = matched[offset:end]
+	writeJSON(w, resp)
+}
+
+func (g *Gmail) createLabel(w http.ResponseWriter, r *http.Request) {
+	var label gmail.Label
+	if err := json.NewDecoder(r.Body).Decode(&label); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, l := range g.labels {
+		if strings.EqualFold(l.Name, label.Name) {
+			writeError(w, http.StatusConflict, "Label name exists or conflicts")
+			return
+		}
+	}
+	label.Id = fmt.Sprintf("Label_%d", len(g.labels)+1)
+	label.Type = "user"
+	g.labels = append(g.labels, &label)
+	writeJSON(w, &label)
+}
+
+func (g *Gmail) patchLabel(w http.ResponseWriter, r *http.Request, id string) {
+	var patch gmail.Label
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, l := range g.labels {
+		if l.Id != id {
+			continue
+		}
+		if patch.Name != "" {
+			// like gmail, the children move along with their parent
+			prefix := l.Name + "/"
+			for _, child := range g.labels {
+				if strings.HasPrefix(child.Name, prefix) {
+					child.Name = patch.Name + "/" + strings.TrimPrefix(child.Name, prefix)
+				}
+			}
+			l.Name = patch.Name
+		}
+		writeJSON(w, l)
+		return
+	}
+	writeError(w, http.StatusNotFound, "Requested entity was not found.")
+}
+
+func (g *Gmail) deleteLabel(w http.ResponseWriter, id string) {
+	for i, l := range g.labels {
+		if l.Id == id {
+			g.labels = append(g.labels[:i], g.labels[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "Requested entity was not found.")
+}
+
+// listMessages filters on the label ids, the search query is ignored
+func (g *Gmail) listMessages(w http.ResponseWriter, r *http.Request) {
+	labelIds := r.URL.Query()["labelIds"]
+	resp := &gmail.ListMessagesResponse{}
+	for _, msg := range g.messages {
+		matched := true
+		for _, id := range labelIds {
+			matched = matched && contains(msg.LabelIds, id)
+		}
+		if matched {
+			resp.Messages = append(resp.Messages, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId})
+		}
+	}
+	writeJSON(w, resp)
+}
+
+func (g *Gmail) batchModify(w http.ResponseWriter, r *http.Request) {
+	var req gmail.BatchModifyMessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, id := range req.Ids {
+		msg, ok := g.messages[id]
+		if !ok {
+			continue
+		}
+		var kept []string
+		for _, l := range msg.LabelIds {
+			if !contains(req.RemoveLabelIds, l) {
+				kept = append(kept, l)
+			}
+		}
+		for _, l := range req.AddLabelIds {
+			if !contains(kept, l) {
+				kept = append(kept, l)
+			}
+		}
+		msg.LabelIds = kept
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gmail) createFilter(w http.ResponseWriter, r *http.Request) {
+	var f gmail.Filter
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.Id = fmt.Sprintf("filter_%d", len(g.filters)+1)
+	g.filters = append(g.filters, &f)
+	writeJSON(w, &f)
+}
+
+func (g *Gmail) deleteFilter(w http.ResponseWriter, id string) {
+	for i, f := range g.filters {
+		if f.Id == id {
+			g.filters = append(g.filters[:i], g.filters[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "Requested entity was not found.")
+}
+
+func (g *Gmail) send(w http.ResponseWriter, r *http.Request) {
+	var msg gmail.Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	msg.Id = fmt.Sprintf("sent-%d", len(g.sent)+1)
+	g.sent = append(g.sent, &msg)
+	writeJSON(w, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId})
+}
+
+func (g *Gmail) watch(w http.ResponseWriter, r *http.Request) {
+	var req gmail.WatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	g.watches = append(g.watches, &req)
+	writeJSON(w, &gmail.WatchResponse{HistoryId: g.historyId, Expiration: 1 << 42})
+}
+
+// withFormat strips the body of the message for the metadata format
+func withFormat(msg *gmail.Message, format string) *gmail.Message {
+	if format != "metadata" || msg.Payload == nil {
+		return msg
+	}
+	meta := *msg
+	meta.Payload = &gmail.MessagePart{MimeType: msg.Payload.MimeType, Headers: msg.Payload.Headers}
+	return &meta
+}
+
+func hasType(h *gmail.History, types []string) bool {
+	return (len(h.MessagesAdded) > 0 && contains(types, "messageAdded")) ||
+		(len(h.LabelsAdded) > 0 && contains(types, "labelAdded"))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes the error in the format of the google apis,
+// so that the clients decode it into a *googleapi.Error
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, code, msg)
+}
@@ -0,0 +1,25 @@
+package fake
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// PushEnvelope builds the body of a Pub/Sub push request
+// carrying a gmail notification for the mailbox
+func PushEnvelope(subscription, email string, historyId uint64) []byte {
+	data := fmt.Sprintf(`{"emailAddress":%q,"historyId":%d}`, email, historyId)
+	var env struct {
+		Message struct {
+			Data      string `json:"data"`
+			MessageID string `json:"message_id"`
+		} `json:"message"`
+		Subscription string `json:"subscription"`
+	}
+	env.Message.Data = base64.URLEncoding.EncodeToString([]byte(data))
+	env.Message.MessageID = fmt.Sprintf("%d", historyId)
+	env.Subscription = subscription
+	b, _ := json.Marshal(&env)
+	return b
+}